@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -9,8 +11,8 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/PavelVaavra/http-from-tcp/internal/headers"
 	"github.com/PavelVaavra/http-from-tcp/internal/request"
@@ -18,43 +20,97 @@ import (
 	"github.com/PavelVaavra/http-from-tcp/internal/server"
 )
 
-const port = 42069
+const (
+	port            = 42069
+	shutdownTimeout = 10 * time.Second
+	// uploads are streamed to disk, this only guards against filling it
+	maxUploadBytes = 8 << 30
+)
+
+var (
+	certFile = flag.String("cert", "", "TLS certificate file, serves HTTPS together with -key")
+	keyFile  = flag.String("key", "", "TLS key file")
+)
 
 func main() {
-	server, err := server.Serve(port, videoHandler)
+	flag.Parse()
+
+	router := server.NewRouter()
+	router.Use(logRequests)
+	router.Handle("GET /video", videoHandler)
+	router.Handle("GET /httpbin/{path...}", chunkHandlerTrailers)
+	router.Handle("POST /upload", uploadHandler)
+	router.Handle("GET /{path...}", htmlHandler)
+
+	cfg := server.Config{
+		Addr:         fmt.Sprintf(":%v", port),
+		Handler:      router.ServeRequest,
+		StreamBodies: true,
+		MaxBodyBytes: maxUploadBytes,
+		ServerHeader: "http-from-tcp",
+	}
+	var certs *server.Certificates
+	if *certFile != "" {
+		certs = server.NewCertificates()
+		if err := certs.Add(*certFile, *keyFile); err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		cfg.TLSConfig = certs.TLSConfig()
+	}
+
+	server, err := server.Listen(cfg)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
+	// SIGHUP reloads the certificate, e.g. after renewal
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-sigChan; sig == syscall.SIGHUP; sig = <-sigChan {
+		if certs == nil {
+			continue
+		}
+		if err := certs.Reload(); err != nil {
+			log.Printf("Error reloading certificate: %v", err)
+			continue
+		}
+		log.Println("Certificate reloaded")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping server: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
 
+func logRequests(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		start := time.Now()
+		next(w, req)
+		log.Printf("%v conn=%d#%d %s %s %d %dB %v", req.RemoteAddr, req.ConnID, req.Seq,
+			req.RequestLine.Method, req.RequestLine.RequestTarget,
+			w.WrittenStatus(), w.WrittenBytes(), time.Since(start))
+	}
+}
+
 func textHandler(w *response.Writer, req *request.Request) {
-	switch req.RequestLine.RequestTarget {
+	switch req.RequestLine.Target.Path {
 	case "/yourproblem":
 		w.StatusCode = response.StatusCodeBadRequest
-		w.StatusPhrase = "Bad Request"
 		w.BodyText = "Your problem is not my problem\n"
 	case "/myproblem":
 		w.StatusCode = response.StatusCodeInternalServerError
-		w.StatusPhrase = "Internal Server Error"
 		w.BodyText = "Woopsie, my bad\n"
 	default:
 		w.StatusCode = response.StatusCodeOK
-		w.StatusPhrase = "OK"
 		w.BodyText = "All good, frfr\n"
 	}
 
-	w.Headers = headers.Headers{
-		"Connection":     "close",
-		"Content-Length": fmt.Sprintf("%v", len(w.BodyText)),
-		"Content-Type":   "text/plain",
-	}
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Content-Type", "text/plain")
 
 	w.WriteStatusLine()
 	w.WriteHeaders()
@@ -62,10 +118,9 @@ func textHandler(w *response.Writer, req *request.Request) {
 }
 
 func htmlHandler(w *response.Writer, req *request.Request) {
-	switch req.RequestLine.RequestTarget {
+	switch req.RequestLine.Target.Path {
 	case "/yourproblem":
 		w.StatusCode = response.StatusCodeBadRequest
-		w.StatusPhrase = "Bad Request"
 		w.BodyText = fmt.Sprintf(`<html>
   <head>
     <title>%s %s</title>
@@ -74,10 +129,9 @@ func htmlHandler(w *response.Writer, req *request.Request) {
     <h1>%s</h1>
     <p>Your request honestly kinda sucked.</p>
   </body>
-</html>`, strconv.Itoa(int(w.StatusCode)), w.StatusPhrase, w.StatusPhrase)
+</html>`, strconv.Itoa(int(w.StatusCode)), response.StatusText(w.StatusCode), response.StatusText(w.StatusCode))
 	case "/myproblem":
 		w.StatusCode = response.StatusCodeInternalServerError
-		w.StatusPhrase = "Internal Server Error"
 		w.BodyText = fmt.Sprintf(`<html>
   <head>
     <title>%s %s</title>
@@ -86,10 +140,9 @@ func htmlHandler(w *response.Writer, req *request.Request) {
     <h1>%s</h1>
     <p>Okay, you know what? This one is on me.</p>
   </body>
-</html>`, strconv.Itoa(int(w.StatusCode)), w.StatusPhrase, w.StatusPhrase)
+</html>`, strconv.Itoa(int(w.StatusCode)), response.StatusText(w.StatusCode), response.StatusText(w.StatusCode))
 	default:
 		w.StatusCode = response.StatusCodeOK
-		w.StatusPhrase = "OK"
 		w.BodyText = fmt.Sprintf(`<html>
   <head>
     <title>%s %s</title>
@@ -98,57 +151,77 @@ func htmlHandler(w *response.Writer, req *request.Request) {
     <h1>%s</h1>
     <p>Your request was an absolute banger.</p>
   </body>
-</html>`, strconv.Itoa(int(w.StatusCode)), w.StatusPhrase, w.StatusPhrase)
+</html>`, strconv.Itoa(int(w.StatusCode)), response.StatusText(w.StatusCode), response.StatusText(w.StatusCode))
 	}
 
-	w.Headers = headers.Headers{
-		"Connection":     "close",
-		"Content-Length": fmt.Sprintf("%v", len(w.BodyText)),
-		"Content-Type":   "text/html",
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Content-Type", "text/html")
+
+	w.WriteStatusLine()
+	w.WriteHeaders()
+	w.WriteBody()
+}
+
+// httpbinGet proxies the request to httpbin.org. The outbound request is
+// cancelled together with the incoming one.
+func httpbinGet(req *request.Request) (*http.Response, error) {
+	url := "https://httpbin.org/" + req.PathValue("path")
+	if req.RequestLine.Target.RawQuery != "" {
+		url += "?" + req.RequestLine.Target.RawQuery
+	}
+	httpReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
+	return http.DefaultClient.Do(httpReq)
+}
+
+func badGateway(w *response.Writer) {
+	w.StatusCode = response.StatusCodeBadGateway
+	w.BodyText = "Upstream request failed\n"
+
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Content-Type", "text/plain")
 
 	w.WriteStatusLine()
 	w.WriteHeaders()
 	w.WriteBody()
 }
 
-func chunkHandler(w *response.Writer, req *request.Request) {
-	url := "https://httpbin.org"
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		url += strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
+// flushWriter sends every write to the client right away, so proxied chunks
+// aren't held in the response buffer until it fills
+type flushWriter struct {
+	w *response.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
 	}
+	return n, fw.w.Flush()
+}
 
-	res, err := http.Get(url)
+func chunkHandler(w *response.Writer, req *request.Request) {
+	res, err := httpbinGet(req)
 	if err != nil {
-		fmt.Printf("http.Get(\"%v\" err - %v\n", url, err.Error())
+		fmt.Printf("httpbinGet: err - %v\n", err.Error())
+		badGateway(w)
+		return
 	}
 	defer res.Body.Close()
 
 	w.StatusCode = response.StatusCode(res.StatusCode)
-	w.StatusPhrase = strings.Split(res.Status, " ")[1]
-	w.BodyChunked = res.Body
 
-	w.Headers = headers.Headers{
-		"Connection":        "close",
-		"Transfer-Encoding": "chunked",
-		"Content-Type":      "text/plain",
-	}
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Transfer-Encoding", "chunked")
+	w.Headers.Set("Content-Type", "text/plain")
 
 	w.WriteStatusLine()
 	w.WriteHeaders()
 
-	buff := make([]byte, 1024)
-	totalBytes := 0
-	for {
-		n, err := w.BodyChunked.Read(buff)
-		if n == 0 && err == io.EOF {
-			break
-		}
-		err = w.WriteChunkedBody(buff[:n])
-		if err != nil {
-			fmt.Printf("w.WriteChunkedBody: err - %v\n", err.Error())
-		}
-		totalBytes += n
+	if _, err := io.Copy(flushWriter{w}, res.Body); err != nil {
+		fmt.Printf("io.Copy: err - %v\n", err.Error())
 	}
 	err = w.WriteChunkedBodyDone()
 	if err != nil {
@@ -157,74 +230,86 @@ func chunkHandler(w *response.Writer, req *request.Request) {
 }
 
 func chunkHandlerTrailers(w *response.Writer, req *request.Request) {
-	url := "https://httpbin.org"
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		url += strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
-	}
-
-	res, err := http.Get(url)
+	res, err := httpbinGet(req)
 	if err != nil {
-		fmt.Printf("http.Get(\"%v\" err - %v\n", url, err.Error())
+		fmt.Printf("httpbinGet: err - %v\n", err.Error())
+		badGateway(w)
+		return
 	}
 	defer res.Body.Close()
 
 	w.StatusCode = response.StatusCode(res.StatusCode)
-	w.StatusPhrase = strings.Split(res.Status, " ")[1]
-	w.BodyChunked = res.Body
 
-	w.Headers = headers.Headers{
-		"Connection":        "close",
-		"Transfer-Encoding": "chunked",
-		"Content-Type":      "text/html`",
-		"Trailer":           "X-Content-SHA256, X-Content-Length",
-	}
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Transfer-Encoding", "chunked")
+	w.Headers.Set("Content-Type", "text/html`")
+	w.Headers.Set("Trailer", "X-Content-SHA256, X-Content-Length")
 
 	w.WriteStatusLine()
 	w.WriteHeaders()
 
-	buff := make([]byte, 1024)
-	var body []byte
-	totalBytes := 0
-	for {
-		n, err := w.BodyChunked.Read(buff)
-		if n == 0 && err == io.EOF {
-			break
-		}
-		body = append(body, buff[:n]...)
-		err = w.WriteChunkedBody(buff[:n])
-		if err != nil {
-			fmt.Printf("w.WriteChunkedBody: err - %v\n", err.Error())
-		}
-		totalBytes += n
+	hash := sha256.New()
+	totalBytes, err := io.Copy(flushWriter{w}, io.TeeReader(res.Body, hash))
+	if err != nil {
+		fmt.Printf("io.Copy: err - %v\n", err.Error())
 	}
 
-	w.Trailers = headers.Headers{
-		"X-Content-SHA256": fmt.Sprintf("%x", sha256.Sum256(body)),
-		"X-Content-Length": strconv.Itoa(totalBytes),
-	}
+	w.Trailers = headers.Headers{}
+	w.Trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash.Sum(nil)))
+	w.Trailers.Set("X-Content-Length", strconv.FormatInt(totalBytes, 10))
 
 	w.WriteTrailers()
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
-	if req.RequestLine.RequestTarget == "/video" {
-		w.StatusCode = response.StatusCodeOK
-		w.StatusPhrase = "OK"
+	f, err := os.Open("assets/vim.mp4")
+	if err != nil {
+		fmt.Printf("os.Open(\"assets/vim.mp4\"): %v\n", err.Error())
+		w.StatusCode = response.StatusCodeNotFound
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Printf("f.Stat: %v\n", err.Error())
+		w.StatusCode = response.StatusCodeInternalServerError
+		return
+	}
 
-		data, err := os.ReadFile("assets/vim.mp4")
-		if err != nil {
-			fmt.Printf("os.ReadFile(\"../../assets/vim.mp4\"): %v\n", err.Error())
-		}
-		w.BodyVideo = data
+	w.StatusCode = response.StatusCodeOK
+
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Headers.Set("Content-Type", "video/mp4")
+
+	w.WriteStatusLine()
+	w.WriteHeaders()
+	// sent with sendfile where the connection supports it
+	io.Copy(w, f)
+}
+
+func uploadHandler(w *response.Writer, req *request.Request) {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		fmt.Printf("os.CreateTemp: %v\n", err.Error())
+		w.StatusCode = response.StatusCodeInternalServerError
+		return
 	}
+	defer f.Close()
 
-	w.Headers = headers.Headers{
-		"Connection":     "close",
-		"Content-Length": fmt.Sprintf("%v", len(w.BodyVideo)),
-		"Content-Type":   "video/mp4",
+	n, err := io.Copy(f, req.BodyReader)
+	if err != nil {
+		w.StatusCode = response.StatusCodeBadRequest
+		w.BodyText = fmt.Sprintf("Upload failed after %v bytes\n", n)
+	} else {
+		w.StatusCode = response.StatusCodeOK
+		w.BodyText = fmt.Sprintf("Saved %v bytes to %v\n", n, f.Name())
 	}
 
+	w.Headers = headers.Headers{}
+	w.Headers.Set("Content-Type", "text/plain")
+
 	w.WriteStatusLine()
 	w.WriteHeaders()
-	w.WriteBodyVideo()
+	w.WriteBody()
 }
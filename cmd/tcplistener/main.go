@@ -39,11 +39,17 @@ func main() {
 			fmt.Printf("- Target: %s\n", r.RequestLine.RequestTarget)
 			fmt.Printf("- Version: %s\n", r.RequestLine.HttpVersion)
 			fmt.Println("Headers:")
-			for k, v := range r.Headers {
+			for k, v := range r.Headers.All() {
 				fmt.Printf("- %v: %v\n", k, v)
 			}
 			fmt.Println("Body:")
 			fmt.Println(string(r.Body))
+			if r.Trailers.Len() > 0 {
+				fmt.Println("Trailers:")
+				for k, v := range r.Trailers.All() {
+					fmt.Printf("- %v: %v\n", k, v)
+				}
+			}
 			
 			fmt.Println("The connection has been closed...")
 		}(conn)
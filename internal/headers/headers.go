@@ -1,32 +1,122 @@
 package headers
 
 import (
+	"errors"
+	"iter"
 	"strings"
 	"unicode"
-	"errors"
 )
 
-type Headers map[string]string
+// Headers holds header fields in the order they were added. A field name may
+// occur several times; names are compared case-insensitively but stored as
+// given. The zero value is an empty set of headers ready to use.
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
+// Get returns all values of key joined with ", ".
 func (h Headers) Get(key string) (value string, err error) {
-	v, ok := h[strings.ToLower(key)]
-	if !ok {
+	values := h.Values(key)
+	if len(values) == 0 {
 		return "", errors.New("Key doesn't exist.")
 	}
-	return v, nil
+	return strings.Join(values, ", "), nil
+}
+
+// Values returns the values of key in the order they were added.
+func (h Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Add appends a value to key, keeping the values already present.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, field{name: key, value: value})
+}
+
+// Set replaces all values of key with value. The field keeps the position of
+// its first occurrence. Like Del, it builds a new slice, so copies of h, e.g.
+// in a request copied by WithContext, are left untouched.
+func (h *Headers) Set(key, value string) {
+	fields := make([]field, 0, len(h.fields)+1)
+	found := false
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.name, key) {
+			fields = append(fields, f)
+		} else if !found {
+			fields = append(fields, field{name: key, value: value})
+			found = true
+		}
+	}
+	h.fields = fields
+	if !found {
+		h.Add(key, value)
+	}
+}
+
+// Del removes all values of key.
+func (h *Headers) Del(key string) {
+	fields := make([]field, 0, len(h.fields))
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.name, key) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+// Clone returns a copy that can be modified independently.
+func (h Headers) Clone() Headers {
+	if h.fields == nil {
+		return Headers{}
+	}
+	return Headers{fields: append([]field(nil), h.fields...)}
 }
 
-func (h Headers) Set(key, value string) {
-	key = strings.ToLower(key)
-	v, ok := h[key]
-	if ok {
-		h[key] = v + ", " + value
-	} else {
-		h[key] = value
+// Len returns the number of fields, counting repeated names separately.
+func (h Headers) Len() int {
+	return len(h.fields)
+}
+
+// All iterates over the fields in the order they were added.
+func (h Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
+		}
+	}
+}
+
+// CanonicalKey returns key with the first letter and every letter following a
+// hyphen upper-cased and the rest lower-cased, e.g. "content-length" becomes
+// "Content-Length".
+func CanonicalKey(key string) string {
+	b := []byte(key)
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			b[i] = c - 'a' + 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			b[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
 	}
+	return string(b)
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	if strings.HasPrefix(string(data), "\r\n") {
 		return len("\r\n"), true, nil
 	}
@@ -39,7 +129,7 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	if len(parts) != 2 {
 		return 0, false, errors.New("No colon found.")
 	}
-	key, value := strings.ToLower(parts[0]), parts[1]
+	key, value := parts[0], parts[1]
 	if len(key) == 0 {
 		return 0, false, errors.New("No key value.")
 	}
@@ -49,11 +139,11 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 0, false, errors.New("There is a whitespace between key and colon.")
 	}
 	key = strings.TrimSpace(key)
-	if !isValid(key) {
+	if !isValid(strings.ToLower(key)) {
 		return 0, false, errors.New("Key contains an invalid character.")
 	}
 	value = strings.TrimSpace(value)
-	h.Set(key, value)
+	h.Add(key, value)
 
 	return len(headerLine[0]) + len("\r\n"), false, nil
 }
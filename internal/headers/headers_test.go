@@ -13,7 +13,7 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -23,28 +23,30 @@ func TestHeadersParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
 	assert.Equal(t, 37, n)
 	assert.False(t, done)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = Headers{}
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
+	assert.Equal(t, "curl/7.81.0", value(headers, "user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
 	// Test: Header with multiple values
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = Headers{}
+	headers.Add("Host", "localhost:42069")
 	data = []byte("  Host:  127.0.0.1:55364   \r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069, 127.0.0.1:55364", headers["host"])
+	assert.Equal(t, "localhost:42069, 127.0.0.1:55364", value(headers, "host"))
 	assert.Equal(t, 29, n)
 	assert.False(t, done)
 
@@ -74,4 +76,68 @@ func TestHeadersParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 	assert.Equal(t, "Key contains an invalid character.", err.Error())
-}
\ No newline at end of file
+}
+func TestHeadersMultipleValues(t *testing.T) {
+	// Test: Repeated fields keep their values and order
+	headers := Headers{}
+	data := []byte("Set-Cookie: a=1; Path=/\r\nHost: localhost:42069\r\nSet-Cookie: b=2\r\n\r\n")
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	n2, _, err := headers.Parse(data[n:])
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n+n2:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Path=/", "b=2"}, headers.Values("set-cookie"))
+	assert.Equal(t, "a=1; Path=/, b=2", value(headers, "Set-Cookie"))
+	var names []string
+	for k := range headers.All() {
+		names = append(names, k)
+	}
+	assert.Equal(t, []string{"Set-Cookie", "Host", "Set-Cookie"}, names)
+
+	// Test: Set replaces all values in place of the first one
+	headers.Set("SET-COOKIE", "c=3")
+	assert.Equal(t, []string{"c=3"}, headers.Values("set-cookie"))
+	assert.Equal(t, 2, headers.Len())
+	names = nil
+	for k := range headers.All() {
+		names = append(names, k)
+	}
+	assert.Equal(t, []string{"SET-COOKIE", "Host"}, names)
+
+	// Test: Clone is independent of the original
+	clone := headers.Clone()
+	clone.Add("Accept", "*/*")
+	clone.Del("host")
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
+	assert.Empty(t, headers.Values("accept"))
+	assert.Equal(t, "*/*", value(clone, "accept"))
+
+	// Test: Set and Del on a copy don't touch the original
+	copied := headers
+	copied.Set("Set-Cookie", "e=5")
+	copied.Del("Host")
+	assert.Equal(t, []string{"c=3"}, headers.Values("set-cookie"))
+	assert.Equal(t, "localhost:42069", value(headers, "host"))
+
+	// Test: Del removes every value
+	headers.Add("Set-Cookie", "d=4")
+	headers.Del("set-cookie")
+	assert.Nil(t, headers.Values("set-cookie"))
+	_, err = headers.Get("set-cookie")
+	require.Error(t, err)
+}
+
+func TestCanonicalKey(t *testing.T) {
+	assert.Equal(t, "Content-Length", CanonicalKey("content-length"))
+	assert.Equal(t, "Content-Length", CanonicalKey("CONTENT-LENGTH"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalKey("X-Content-SHA256"))
+	assert.Equal(t, "Www-Authenticate", CanonicalKey("WWW-Authenticate"))
+	assert.Equal(t, "Host", CanonicalKey("host"))
+}
+
+// value returns the combined value of key, or "" if it is missing
+func value(h Headers, key string) string {
+	v, _ := h.Get(key)
+	return v
+}
@@ -0,0 +1,63 @@
+package request
+
+import (
+	"errors"
+	"io"
+)
+
+// maxBodyDrain is the most unread body bytes discarded to keep a connection
+// usable for the next request.
+const maxBodyDrain = 256 << 10
+
+// bodyReader streams a request body straight from the connection, decoding
+// Content-Length or chunked framing with the request's parser.
+type bodyReader struct {
+	rr  *Reader
+	req *Request
+	// decoded bytes not yet returned by Read
+	pending  []byte
+	closed   bool
+	closeErr error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("Body read after close.")
+	}
+	if len(b.pending) == 0 {
+		if b.req.State == requestStateDone {
+			return 0, io.EOF
+		}
+		err := b.rr.readUntil(b.req, func() bool {
+			return len(b.req.Body) > 0 || b.req.State == requestStateDone
+		})
+		if err != nil {
+			return 0, err
+		}
+		b.pending = b.req.Body
+		b.req.Body = nil
+		if len(b.pending) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// Close discards the rest of the body so the next request can be read. It
+// fails if the body can't be drained, in which case the connection must be
+// closed.
+func (b *bodyReader) Close() error {
+	if b.closed {
+		return b.closeErr
+	}
+	_, err := io.CopyN(io.Discard, b, maxBodyDrain+1)
+	b.closed = true
+	if err == nil {
+		b.closeErr = errors.New("Unread body too large to drain.")
+	} else if err != io.EOF {
+		b.closeErr = err
+	}
+	return b.closeErr
+}
@@ -0,0 +1,55 @@
+package request
+
+import "errors"
+
+type ParseErrorKind int
+
+// Kinds of invalid requests, so the server can pick the response status
+const (
+	MalformedRequestLine ParseErrorKind = iota
+	BadHeader
+	BadBody
+	UnsupportedVersion
+	URITooLong
+	HeadersTooLarge
+	BodyTooLarge
+	Timeout
+)
+
+// ParseError is returned by Reader.ReadRequest and Request.BodyReader when
+// the client sent an invalid request. The connection can't be reused after it.
+type ParseError struct {
+	Kind ParseErrorKind
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// newParseError classifies err by the state the parser was in when it
+// occurred, unless it's already a ParseError
+func newParseError(state requestState, err error) error {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return err
+	}
+	kind := BadBody
+	switch {
+	case errors.Is(err, ErrVersionNotSupported):
+		kind = UnsupportedVersion
+	case errors.Is(err, ErrRequestTimeout):
+		kind = Timeout
+	case state == requestStateInitialized:
+		kind = MalformedRequestLine
+	case state == requestStateParsingHeaders:
+		kind = BadHeader
+	}
+	return &ParseError{Kind: kind, Err: err}
+}
+
+var errBodyTooLarge = &ParseError{Kind: BodyTooLarge, Err: errors.New("Body exceeds the size limit.")}
@@ -1,6 +1,10 @@
 package request
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"net"
@@ -15,8 +19,91 @@ import (
 type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
-	Body        []byte
-	State       requestState
+	// Body is the fully buffered body. It stays empty when the Reader streams
+	// bodies, read BodyReader instead.
+	Body []byte
+	// BodyReader reads the body in both buffered and streaming mode
+	BodyReader io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body
+	Trailers headers.Headers
+	// PathValues holds the wildcards of the matched route, see PathValue
+	PathValues map[string]string
+	// TLS describes the connection's TLS session, it is nil for plaintext
+	// connections
+	TLS *tls.ConnectionState
+	// RemoteAddr is the client's address. Behind a trusted proxy it is the
+	// address the proxy reports in X-Forwarded-For, PeerAddr is the other end
+	// of the connection, or the source address of its PROXY protocol header.
+	RemoteAddr net.Addr
+	PeerAddr   net.Addr
+	LocalAddr  net.Addr
+	// ConnID identifies the connection among all the server has accepted,
+	// Seq counts the requests on it starting at 1
+	ConnID uint64
+	Seq    int
+	// ReceivedAt is when the first byte of the request arrived
+	ReceivedAt time.Time
+	State      requestState
+
+	ctx context.Context
+
+	// bytes of the body decoded so far
+	bodyLength int
+	// limit of bodyLength, 0 means no limit
+	maxBodyBytes int
+	// bytes of header and trailer lines parsed so far
+	fieldBytes int
+	// bytes of the current chunk not yet read
+	chunkRemaining int
+}
+
+// Context returns the request's context. The server cancels it when the
+// client goes away, the server shuts down or is closed, or the handler's
+// time is up. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx,
+// e.g. for middleware to attach request-scoped values.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// Host returns the host the request is addressed to, taken from an
+// absolute-form target or else from the Host header.
+func (r *Request) Host() string {
+	if r.RequestLine.Target.Host != "" {
+		return r.RequestLine.Target.Host
+	}
+	host, _ := r.Headers.Get("host")
+	return host
+}
+
+// PathValue returns the path segment matched by the route wildcard name, or
+// "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.PathValues[name]
+}
+
+// BodyReceived reports whether the whole body was read from the connection.
+// It is false while a streamed body is still arriving.
+func (r *Request) BodyReceived() bool {
+	return r.State == requestStateDone
+}
+
+// PeerCertificate returns the client's certificate if the server verified it,
+// or nil.
+func (r *Request) PeerCertificate() *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
 }
 
 type requestState int
@@ -25,12 +112,32 @@ const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingChunkDataEnd
+	requestStateParsingTrailers
 	requestStateDone
 )
 
+// Methods defined by RFC 9110 and RFC 5789. Any other token is accepted as a
+// method too, it is up to the server whether it implements it.
+const (
+	MethodGet     = "GET"
+	MethodHead    = "HEAD"
+	MethodPost    = "POST"
+	MethodPut     = "PUT"
+	MethodPatch   = "PATCH"
+	MethodDelete  = "DELETE"
+	MethodConnect = "CONNECT"
+	MethodOptions = "OPTIONS"
+	MethodTrace   = "TRACE"
+)
+
 type RequestLine struct {
-	HttpVersion   string
+	HttpVersion string
+	// RequestTarget is the target as it was sent, Target is its parsed form
 	RequestTarget string
+	Target        Target
 	Method        string
 }
 
@@ -52,6 +159,7 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		r.fieldBytes += n
 		if n == 0 && err == nil {
 			return 0, nil
 		}
@@ -61,21 +169,91 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 		}
 		return n, nil
 	} else if r.State == requestStateParsingBody {
+		transferEncoding, errTE := r.Headers.Get("transfer-encoding")
 		contentLengthStr, err := r.Headers.Get("content-length")
+		if errTE == nil {
+			if r.RequestLine.HttpVersion == "1.0" {
+				return 0, errors.New("Transfer-Encoding not allowed in HTTP/1.0.")
+			}
+			if err == nil {
+				return 0, errors.New("Both Transfer-Encoding and Content-Length present.")
+			}
+			if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+				return 0, errors.New("Transfer-Encoding not supported.")
+			}
+			r.State = requestStateParsingChunkSize
+			return 0, nil
+		}
 		if contentLengthStr == "" && err != nil {
 			r.State = requestStateDone
-			return len(data), nil
+			return 0, nil
+		}
+		// 1*DIGIT only, a lenient parser could read a length the proxy in
+		// front of us doesn't
+		if !isDigits(contentLengthStr, "0123456789") {
+			return 0, errors.New("Content-Length invalid number.")
 		}
-		r.Body = data
 		contentLengthInt, err := strconv.Atoi(contentLengthStr)
 		if err != nil {
 			return 0, errors.New("Content-Length invalid number.")
 		}
-		if len(r.Body) != contentLengthInt {
-			return 0, errors.New("Content-Length doesn't equal to Body length.")
+		if r.maxBodyBytes > 0 && contentLengthInt > r.maxBodyBytes {
+			return 0, errBodyTooLarge
+		}
+		remaining := contentLengthInt - r.bodyLength
+		n := min(remaining, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLength += n
+		if r.bodyLength == contentLengthInt {
+			r.State = requestStateDone
+		}
+		return n, nil
+	} else if r.State == requestStateParsingChunkSize {
+		size, n, err := parseChunkSize(string(data))
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if r.maxBodyBytes > 0 && r.bodyLength+size > r.maxBodyBytes {
+			return 0, errBodyTooLarge
+		}
+		if size == 0 {
+			r.State = requestStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.State = requestStateParsingChunkData
+		}
+		return n, nil
+	} else if r.State == requestStateParsingChunkData {
+		n := min(r.chunkRemaining, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.bodyLength += n
+		r.chunkRemaining -= n
+		if r.chunkRemaining == 0 {
+			r.State = requestStateParsingChunkDataEnd
+		}
+		return n, nil
+	} else if r.State == requestStateParsingChunkDataEnd {
+		if len(data) < len("\r\n") {
+			return 0, nil
+		}
+		if string(data[:2]) != "\r\n" {
+			return 0, errors.New("Chunk data not followed by CRLF.")
+		}
+		r.State = requestStateParsingChunkSize
+		return len("\r\n"), nil
+	} else if r.State == requestStateParsingTrailers {
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, err
 		}
-		r.State = requestStateDone
-		return len(r.Body), nil
+		r.fieldBytes += n
+		if done {
+			r.State = requestStateDone
+		}
+		return n, nil
 	} else if r.State == requestStateDone {
 		return 0, errors.New("error: trying to read data in a done state")
 	} else {
@@ -86,12 +264,14 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.State != requestStateDone {
+		state := r.State
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
-			return 0, err
+			return 0, newParseError(state, err)
 		}
 		totalBytesParsed += n
-		if n == 0 && err == nil || r.State == requestStateParsingBody {
+		// nothing consumed and no state change means more data is needed
+		if n == 0 && r.State == state {
 			return totalBytesParsed, nil
 		}
 	}
@@ -110,74 +290,284 @@ func parseRequestLine(s string) (*RequestLine, int, error) {
 		return nil, 0, errors.New("Request line doesn't consist of three parts.")
 	}
 	method := parts[0]
-	for _, c := range method {
-		if c < 'A' || c > 'Z' {
-			return nil, 0, errors.New("Method contains other than capital letters.")
-		}
-	}
-	if method != "GET" && method != "POST" && method != "PUT" && method != "DELETE" {
+	if len(method) == 0 {
 		return nil, 0, errors.New("Not a valid method.")
 	}
+	if !isToken(method) {
+		return nil, 0, errors.New("Method contains an invalid character.")
+	}
 
 	requestTarget := parts[1]
+	target, err := parseTarget(method, requestTarget)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	httpVersion := strings.Split(parts[2], "/")[1]
-	if httpVersion != "1.1" {
-		return nil, 0, errors.New("HTTP version not equal to 1.1")
+	httpVersion, ok := strings.CutPrefix(parts[2], "HTTP/")
+	if !ok || !isVersionNumber(httpVersion) {
+		return nil, 0, errors.New("Malformed HTTP version.")
+	}
+	if httpVersion != "1.1" && httpVersion != "1.0" {
+		return nil, 0, ErrVersionNotSupported
 	}
 
 	return &RequestLine{
 		HttpVersion:   httpVersion,
 		RequestTarget: requestTarget,
+		Target:        target,
 		Method:        method,
 	}, len(requestLine[0]) + len("\r\n"), nil
 }
 
+// isVersionNumber reports whether s has the form DIGIT "." DIGIT
+func isVersionNumber(s string) bool {
+	return len(s) == 3 && '0' <= s[0] && s[0] <= '9' && s[1] == '.' && '0' <= s[2] && s[2] <= '9'
+}
+
+// isToken reports whether s consists only of RFC 9110 token characters
+func isToken(s string) bool {
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z',
+			'A' <= r && r <= 'Z',
+			'0' <= r && r <= '9',
+			strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+			// allowed
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isDigits reports whether s is a non-empty string of the given digits
+func isDigits(s, digits string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune(digits, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseChunkSize parses a chunk size line, ignoring any chunk extensions
+func parseChunkSize(s string) (int, int, error) {
+	line := strings.Split(s, "\r\n")
+	// \r\n wasn't found
+	if len(line) == 1 {
+		return 0, 0, nil
+	}
+	sizeStr, _, _ := strings.Cut(line[0], ";")
+	sizeStr = strings.TrimSpace(sizeStr)
+	if !isDigits(sizeStr, "0123456789abcdefABCDEF") {
+		return 0, 0, errors.New("Chunk size invalid hex number.")
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 32)
+	if err != nil {
+		return 0, 0, errors.New("Chunk size invalid hex number.")
+	}
+	return int(size), len(line[0]) + len("\r\n"), nil
+}
+
 const bufferSize = 8
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buff := make([]byte, bufferSize, bufferSize)
+// minBodyRead is the least a read asks the connection for once the headers
+// are parsed. The buffer only grows to the longest line otherwise, which
+// would read bodies in pieces of a few bytes.
+const minBodyRead = 32 << 10
+
+// ErrRequestTimeout is returned when a started request isn't received within
+// the Reader's HeaderTimeout or BodyTimeout.
+var ErrRequestTimeout = errors.New("Request timed out.")
+
+// ErrVersionNotSupported is returned for well-formed HTTP versions other than
+// 1.0 and 1.1.
+var ErrVersionNotSupported = errors.New("HTTP version not supported.")
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
 
-	readToIndex := 0
+// Reader reads consecutive requests from a single connection. Bytes read past
+// the end of one request are kept and parsed as the start of the next one.
+type Reader struct {
+	// HeaderTimeout limits the time from the first byte of a request to the
+	// end of its headers. Zero means no limit.
+	HeaderTimeout time.Duration
+	// BodyTimeout limits the time a single body read may wait for data, so
+	// slow clients are cut off without limiting the size of uploads.
+	// Zero means no limit.
+	BodyTimeout time.Duration
+	// StreamBody makes ReadRequest return as soon as the headers are parsed.
+	// The body is then read through Request.BodyReader and never buffered.
+	StreamBody bool
+	// MaxRequestLineBytes limits the request line, MaxHeaderBytes the header
+	// and trailer lines and MaxBodyBytes the decoded body. Zero means no limit.
+	MaxRequestLineBytes int
+	MaxHeaderBytes      int
+	MaxBodyBytes        int
+	// OnStart is called when the first byte of a request arrives, e.g. to
+	// stop treating the connection as idle
+	OnStart func()
+
+	reader         io.Reader
+	buff           []byte
+	readToIndex    int
+	headerDeadline time.Time
+	// body of the last streamed request, drained before the next one is read
+	body *bodyReader
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buff:   make([]byte, bufferSize, bufferSize),
+	}
+}
+
+// ReadRequest returns the next request. It returns io.EOF if the connection
+// was closed before any byte of a new request arrived. Timeouts apply only if
+// the underlying reader supports read deadlines (e.g. net.Conn); while waiting
+// for the first byte the caller's deadline is left untouched.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if rr.body != nil {
+		err := rr.body.Close()
+		rr.body = nil
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	req := Request{
 		RequestLine: RequestLine{},
 		Headers:     headers.Headers{},
+		Trailers:    headers.Headers{},
 		State:       requestStateInitialized,
+
+		maxBodyBytes: rr.MaxBodyBytes,
 	}
+	rr.headerDeadline = time.Time{}
 
-	for req.State != requestStateDone {
-		if (readToIndex + 1) >= len(buff) {
-			buff = append(buff, make([]byte, len(buff), cap(buff))...)
-		}
-		if conn, ok := reader.(net.Conn); ok {
-			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	err := rr.readUntil(&req, func() bool {
+		return req.State == requestStateDone || rr.StreamBody && req.State >= requestStateParsingBody
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rr.StreamBody {
+		rr.body = &bodyReader{
+			rr:      rr,
+			req:     &req,
+			pending: req.Body,
 		}
-		n, err := reader.Read(buff[readToIndex:])
-		if ne, ok := err.(net.Error); (ok && ne.Timeout()) || (n == 0 && err == io.EOF) {
-			if req.State != requestStateParsingBody {
-				return nil, errors.New("No requestStateParsingBody after EOF.")
-			}
-			n, err = req.parse(buff[:readToIndex])
-			if err != nil {
-				return nil, err
+		req.Body = nil
+		req.BodyReader = rr.body
+	} else {
+		req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+	}
+	return &req, nil
+}
+
+// readUntil parses buffered data and reads more from the connection until
+// stop reports true.
+func (rr *Reader) readUntil(req *Request, stop func() bool) error {
+	for {
+		if req.ReceivedAt.IsZero() && rr.readToIndex > 0 {
+			req.ReceivedAt = time.Now()
+			if rr.OnStart != nil {
+				rr.OnStart()
 			}
-			req.State = requestStateDone
-			continue
+		}
+		n, err := req.parse(rr.buff[:rr.readToIndex])
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			copy(rr.buff, rr.buff[n:rr.readToIndex])
+			rr.readToIndex -= n
+		}
+		if stop() {
+			return nil
+		}
+		if req.State == requestStateDone {
+			return errors.New("error: trying to read data in a done state")
+		}
+		if err := rr.checkLimits(req); err != nil {
+			return err
 		}
 
-		readToIndex += n
-		if req.State != requestStateParsingBody {
-			n, err = req.parse(buff[:readToIndex])
-			if err != nil {
-				return nil, err
+		started := req.State != requestStateInitialized || rr.readToIndex > 0
+		if conn, ok := rr.reader.(readDeadliner); ok && started {
+			conn.SetReadDeadline(rr.readDeadline(req))
+		}
+		if rr.readToIndex >= len(rr.buff) {
+			rr.buff = append(rr.buff, make([]byte, len(rr.buff), cap(rr.buff))...)
+		}
+		if free := len(rr.buff) - rr.readToIndex; req.State >= requestStateParsingBody && free < minBodyRead {
+			rr.buff = append(rr.buff, make([]byte, minBodyRead-free)...)
+		}
+		n, err = rr.reader.Read(rr.buff[rr.readToIndex:])
+		rr.readToIndex += n
+		if n == 0 && err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && started {
+				return newParseError(req.State, ErrRequestTimeout)
+			}
+			if err != io.EOF {
+				return err
+			}
+			if !started {
+				return io.EOF
 			}
-			if n != 0 {
-				copy(buff, buff[n:])
-				readToIndex -= n
+			if req.State == requestStateInitialized || req.State == requestStateParsingHeaders {
+				return newParseError(req.State, errors.New("No requestStateParsingBody after EOF."))
 			}
+			return newParseError(req.State, errors.New("Body ended before its announced length."))
 		}
 	}
+}
 
-	return &req, nil
+// maxChunkSizeLine limits a chunk size line including its extensions
+const maxChunkSizeLine = 1024
+
+// checkLimits fails if the unparsed, incomplete line in the buffer can't fit
+// the limits any more
+func (rr *Reader) checkLimits(req *Request) error {
+	switch req.State {
+	case requestStateInitialized:
+		if rr.MaxRequestLineBytes > 0 && rr.readToIndex > rr.MaxRequestLineBytes {
+			return &ParseError{Kind: URITooLong, Err: errors.New("Request line too long.")}
+		}
+	case requestStateParsingHeaders, requestStateParsingTrailers:
+		if rr.MaxHeaderBytes > 0 && req.fieldBytes+rr.readToIndex > rr.MaxHeaderBytes {
+			return &ParseError{Kind: HeadersTooLarge, Err: errors.New("Headers too large.")}
+		}
+	case requestStateParsingChunkSize:
+		if rr.readToIndex > maxChunkSizeLine {
+			return &ParseError{Kind: BadBody, Err: errors.New("Chunk size line too long.")}
+		}
+	}
+	return nil
+}
+
+// readDeadline returns the deadline for the next read. The header deadline is
+// fixed when the request starts, the body deadline moves with every read.
+func (rr *Reader) readDeadline(req *Request) time.Time {
+	if req.State == requestStateInitialized || req.State == requestStateParsingHeaders {
+		if rr.headerDeadline.IsZero() && rr.HeaderTimeout > 0 {
+			rr.headerDeadline = time.Now().Add(rr.HeaderTimeout)
+		}
+		return rr.headerDeadline
+	}
+	if rr.BodyTimeout > 0 {
+		return time.Now().Add(rr.BodyTimeout)
+	}
+	return time.Time{}
+}
+
+func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
 }
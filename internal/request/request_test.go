@@ -5,6 +5,12 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/headers"
 )
 
 type chunkReader struct {
@@ -78,32 +84,61 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 	assert.Equal(t, "Request line doesn't consist of three parts.", err.Error())
 
-	// Test: Method doesn't contain only capital letters
+	// Test: Method contains a non-token character
 	reader = &chunkReader{
-		data:            "get /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		data:            "G@T /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 9,
 	}
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
-	assert.Equal(t, "Method contains other than capital letters.", err.Error())
+	assert.Equal(t, "Method contains an invalid character.", err.Error())
+
+	// Test: Any token is accepted as a method
+	for _, method := range []string{"HEAD", "OPTIONS", "PATCH", "TRACE", "GETT"} {
+		reader = &chunkReader{
+			data:            method + " /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 2,
+		}
+		r, err = RequestFromReader(reader)
+		require.NoError(t, err)
+		require.NotNil(t, r)
+		assert.Equal(t, method, r.RequestLine.Method)
+	}
+
+	// Test: Invalid version in Request line
+	reader = &chunkReader{
+		data:            "GET /coffee HTTP/1.2\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrVersionNotSupported)
 
-	// Test: Invalid method (out of order) Request line
+	// Test: Malformed version in Request line
 	reader = &chunkReader{
-		data:            "GETT /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
-		numBytesPerRead: 2,
+		data:            "GET /coffee HTTP1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 4,
 	}
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
-	assert.Equal(t, "Not a valid method.", err.Error())
+	assert.Equal(t, "Malformed HTTP version.", err.Error())
 
-	// Test: Invalid version in Request line
+	// Test: Good HTTP/1.0 Request line
 	reader = &chunkReader{
-		data:            "GET /coffee HTTP/1.2\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
+		data:            "GET /coffee HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: HTTP/1.0 request with chunked body
+	reader = &chunkReader{
+		data:            "POST /coffee HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
 		numBytesPerRead: 4,
 	}
 	_, err = RequestFromReader(reader)
 	require.Error(t, err)
-	assert.Equal(t, "HTTP version not equal to 1.1", err.Error())
 }
 
 func TestRequestLineHeadersParse(t *testing.T) {
@@ -115,9 +150,9 @@ func TestRequestLineHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", value(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", value(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", value(r.Headers, "accept"))
 
 	// Test: Empty Headers
 	reader = &chunkReader{
@@ -145,7 +180,7 @@ func TestRequestLineHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42069", r.Headers["host"])
+	assert.Equal(t, "localhost:42069, localhost:42069", value(r.Headers, "host"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -155,7 +190,7 @@ func TestRequestLineHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
+	assert.Equal(t, "localhost:42069", value(r.Headers, "host"))
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -230,4 +265,367 @@ func TestRequestLineHeadersBodyParse(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 	assert.Equal(t, "", string(r.Body))
-}
\ No newline at end of file
+}
+func TestReaderConsecutiveRequests(t *testing.T) {
+	// Test: Two pipelined requests on one connection
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+	assert.Equal(t, "hello", string(r.Body))
+	assert.False(t, r.ReceivedAt.IsZero())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", string(r.Body))
+
+	// Test: Connection closed between requests
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunked body with extension and trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7;name=value\r\nworld!\n\r\n" +
+			"0\r\n" +
+			"X-Content-Length: 13\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "13", value(r.Trailers, "x-content-length"))
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "", string(r.Body))
+	assert.Empty(t, r.Trailers)
+
+	// Test: Both Transfer-Encoding and Content-Length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+	assert.Equal(t, "Both Transfer-Encoding and Content-Length present.", err.Error())
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing last chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestReaderTimeouts(t *testing.T) {
+	// Test: Headers not finished within HeaderTimeout
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost:42069\r\n"))
+	reader := NewReader(server)
+	reader.HeaderTimeout = 50 * time.Millisecond
+	_, err := reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestTimeout)
+
+	// Test: Body stalls longer than BodyTimeout
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+	reader = NewReader(server)
+	reader.BodyTimeout = 50 * time.Millisecond
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestTimeout)
+
+	// Test: Slow but steady body within BodyTimeout
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n"))
+		for _, part := range []string{"hello", "world"} {
+			time.Sleep(30 * time.Millisecond)
+			client.Write([]byte(part))
+		}
+	}()
+	reader = NewReader(server)
+	reader.BodyTimeout = 50 * time.Millisecond
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "helloworld", string(r.Body))
+}
+
+// countingReader counts the reads, each of which would be a syscall on a
+// connection
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func TestBodyReadSize(t *testing.T) {
+	body := strings.Repeat("x", 1<<20)
+	data := "POST /upload HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+
+	// Test: Streamed bodies are read in large pieces
+	conn := &countingReader{Reader: strings.NewReader(data)}
+	reader := NewReader(conn)
+	reader.StreamBody = true
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	n, err := io.Copy(io.Discard, r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	assert.Less(t, conn.reads, 64)
+
+	// Test: So are buffered ones
+	conn = &countingReader{Reader: strings.NewReader(data)}
+	r, err = NewReader(conn).ReadRequest()
+	require.NoError(t, err)
+	assert.Len(t, r.Body, len(body))
+	assert.Less(t, conn.reads, 64)
+}
+
+func TestStreamBody(t *testing.T) {
+	// Test: Streamed Content-Length body followed by another request
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n" +
+			"POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"7\r\nworld!\n\r\n" +
+			"0\r\n\r\n" +
+			"GET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	reader.StreamBody = true
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Streamed chunked body
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Request following a streamed chunked body
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "GET", r.RequestLine.Method)
+
+	// Test: Unread body is drained before the next request
+	reader = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /coffee HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	reader.StreamBody = true
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+
+	// Test: Buffered mode also exposes BodyReader
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	body, err = io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestRequestTargetParse(t *testing.T) {
+	// Test: Origin-form with decoded path and multi-valued query
+	reader := &chunkReader{
+		data:            "GET /videos/./my%20clip//?id=1&tag=a&tag=b%26c HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	target := r.RequestLine.Target
+	assert.Equal(t, OriginForm, target.Form)
+	assert.Equal(t, "/videos/my clip/", target.Path)
+	assert.Equal(t, "/videos/./my%20clip//", target.RawPath)
+	assert.Equal(t, "id=1&tag=a&tag=b%26c", target.RawQuery)
+	assert.Equal(t, "1", target.Query.Get("id"))
+	assert.Equal(t, []string{"a", "b&c"}, target.Query["tag"])
+
+	// Test: Absolute-form
+	reader = &chunkReader{
+		data:            "GET HTTP://localhost:42069?x=1 HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	target = r.RequestLine.Target
+	assert.Equal(t, AbsoluteForm, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "localhost:42069", target.Host)
+	assert.Equal(t, "/", target.Path)
+	assert.Equal(t, "1", target.Query.Get("x"))
+
+	// Test: Authority-form
+	reader = &chunkReader{
+		data:            "CONNECT localhost:443 HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.RequestLine.Target.Form)
+	assert.Equal(t, "localhost:443", r.RequestLine.Target.Host)
+
+	// Test: Asterisk-form
+	reader = &chunkReader{
+		data:            "OPTIONS * HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.RequestLine.Target.Form)
+
+	// Test: Invalid targets
+	for _, line := range []string{
+		"GET /videos#intro HTTP/1.1",
+		"GET /videos/../secret HTTP/1.1",
+		"GET /videos/%2e%2E/secret HTTP/1.1",
+		"GET /files/..%2F..%2Fetc/passwd HTTP/1.1",
+		"GET /a/%2e%2e%2fb HTTP/1.1",
+		"GET /a/..%5Cb HTTP/1.1",
+		"GET /videos/%zz HTTP/1.1",
+		"GET /videos?id=%zz HTTP/1.1",
+		"GET * HTTP/1.1",
+		"GET videos HTTP/1.1",
+		"CONNECT /videos HTTP/1.1",
+	} {
+		reader = &chunkReader{
+			data:            line + "\r\n\r\n",
+			numBytesPerRead: 5,
+		}
+		_, err = RequestFromReader(reader)
+		require.Error(t, err, line)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		kind ParseErrorKind
+	}{
+		{"GET /coffee\r\n\r\n", MalformedRequestLine},
+		{"GET /coffee HTTP/2.0\r\n\r\n", UnsupportedVersion},
+		{"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", URITooLong},
+		{"GET / HTTP/1.1\r\nHost localhost:42069\r\n\r\n", BadHeader},
+		{"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 200) + "\r\n\r\n", HeadersTooLarge},
+		{"POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", BadBody},
+		{"POST / HTTP/1.1\r\nContent-Length: +3\r\n\r\nabc", BadBody},
+		{"POST / HTTP/1.1\r\nContent-Length: -0\r\n\r\n", BadBody},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n+3\r\nabc\r\n0\r\n\r\n", BadBody},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0x3\r\nabc\r\n0\r\n\r\n", BadBody},
+		{"POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\nhello world", BodyTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n", BodyTooLarge},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Long: " + strings.Repeat("a", 200) + "\r\n\r\n", HeadersTooLarge},
+	}
+	for _, tt := range tests {
+		reader := NewReader(&chunkReader{
+			data:            tt.data,
+			numBytesPerRead: 7,
+		})
+		reader.MaxRequestLineBytes = 64
+		reader.MaxHeaderBytes = 128
+		reader.MaxBodyBytes = 10
+		_, err := reader.ReadRequest()
+		var parseErr *ParseError
+		require.ErrorAs(t, err, &parseErr, tt.data)
+		assert.Equal(t, tt.kind, parseErr.Kind, tt.data)
+	}
+
+	// Test: Timeouts are parse errors too
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n"))
+	reader := NewReader(server)
+	reader.HeaderTimeout = 50 * time.Millisecond
+	_, err := reader.ReadRequest()
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, Timeout, parseErr.Kind)
+}
+
+// value returns the combined value of key, or "" if it is missing
+func value(h headers.Headers, key string) string {
+	v, _ := h.Get(key)
+	return v
+}
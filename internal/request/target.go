@@ -0,0 +1,128 @@
+package request
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+type TargetForm int
+
+// Request target forms defined by RFC 9112 section 3.2
+const (
+	// OriginForm is an absolute path with an optional query, e.g. /videos?id=1
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, sent to proxies, e.g. http://example.com/videos
+	AbsoluteForm
+	// AuthorityForm is host and port, only used by CONNECT, e.g. example.com:443
+	AuthorityForm
+	// AsteriskForm is "*", only used by a server-wide OPTIONS
+	AsteriskForm
+)
+
+// Target is the parsed request target.
+type Target struct {
+	Form TargetForm
+	// Scheme is set for the absolute-form only
+	Scheme string
+	// Host is the host and optional port of the absolute-form and the
+	// authority-form. For the origin-form it is in the Host header.
+	Host string
+	// Path is percent-decoded and normalized, "." segments and repeated
+	// slashes are removed
+	Path string
+	// RawPath is the path as it was sent
+	RawPath  string
+	RawQuery string
+	// Query holds the decoded query parameters, use Query.Get for the first
+	// value of a parameter and Query[name] for all of them
+	Query url.Values
+}
+
+func parseTarget(method, s string) (Target, error) {
+	if strings.Contains(s, "#") {
+		return Target{}, errors.New("Request target contains a fragment.")
+	}
+
+	if s == "*" {
+		if method != MethodOptions {
+			return Target{}, errors.New("Asterisk request target is only allowed for OPTIONS.")
+		}
+		return Target{Form: AsteriskForm, Query: url.Values{}}, nil
+	}
+
+	if method == MethodConnect {
+		if strings.ContainsAny(s, "/?@") || !strings.Contains(s, ":") {
+			return Target{}, errors.New("CONNECT request target isn't host:port.")
+		}
+		return Target{Form: AuthorityForm, Host: s, Query: url.Values{}}, nil
+	}
+
+	target := Target{Form: OriginForm}
+	if !strings.HasPrefix(s, "/") {
+		scheme, rest, ok := strings.Cut(s, "://")
+		if !ok || scheme == "" || !isToken(scheme) {
+			return Target{}, errors.New("Request target isn't origin-form nor absolute-form.")
+		}
+		host, path := rest, "/"
+		if i := strings.IndexAny(rest, "/?"); i >= 0 {
+			host, path = rest[:i], rest[i:]
+			if strings.HasPrefix(path, "?") {
+				path = "/" + path
+			}
+		}
+		if host == "" || strings.Contains(host, "@") {
+			return Target{}, errors.New("Request target has an invalid authority.")
+		}
+		target.Form = AbsoluteForm
+		target.Scheme = strings.ToLower(scheme)
+		target.Host = host
+		s = path
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(s, "?")
+	path, err := normalizePath(rawPath)
+	if err != nil {
+		return Target{}, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Target{}, errors.New("Query contains an invalid escape.")
+	}
+	target.Path = path
+	target.RawPath = rawPath
+	target.RawQuery = rawQuery
+	target.Query = query
+	return target, nil
+}
+
+// normalizePath percent-decodes an absolute path segment by segment, drops
+// "." and empty segments and rejects ".." so a path can't escape its root.
+// Segments decoding to something containing a slash are rejected too, they
+// would turn into other segments, e.g. "..%2F..".
+func normalizePath(rawPath string) (string, error) {
+	segments := strings.Split(rawPath, "/")
+	normalized := make([]string, 0, len(segments))
+	for _, segment := range segments[1:] {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", errors.New("Path contains an invalid escape.")
+		}
+		if strings.ContainsAny(decoded, `/\`) {
+			return "", errors.New("Path segment contains an encoded slash.")
+		}
+		if decoded == ".." {
+			return "", errors.New("Path contains a .. segment.")
+		}
+		if decoded == "." || decoded == "" {
+			continue
+		}
+		normalized = append(normalized, decoded)
+	}
+	path := "/" + strings.Join(normalized, "/")
+	// keep the trailing slash of directory-like paths
+	if strings.HasSuffix(rawPath, "/") && path != "/" {
+		path += "/"
+	}
+	return path, nil
+}
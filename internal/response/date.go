@@ -0,0 +1,32 @@
+package response
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dateFormat is the IMF-fixdate format of the Date header, always in GMT
+const dateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+type cachedDate struct {
+	unix  int64
+	value string
+}
+
+// dateCache holds the Date value of the current second, so busy servers
+// format it once per second instead of once per response
+var dateCache atomic.Pointer[cachedDate]
+
+// now is replaced by tests
+var now = time.Now
+
+// date returns the Date header value for t
+func date(t time.Time) string {
+	unix := t.Unix()
+	if cached := dateCache.Load(); cached != nil && cached.unix == unix {
+		return cached.value
+	}
+	value := t.UTC().Format(dateFormat)
+	dateCache.Store(&cachedDate{unix: unix, value: value})
+	return value
+}
@@ -0,0 +1,35 @@
+package response
+
+import "errors"
+
+// Reasons a write method refuses to write
+var (
+	ErrInvalidStatusCode = errors.New("Status code must have three digits.")
+	ErrStatusLineWritten = errors.New("Status line already written.")
+	ErrHeadersWritten    = errors.New("Headers already written.")
+	ErrResponseDone      = errors.New("Response already finished.")
+	ErrNotChunked        = errors.New("Response body is not chunked.")
+	ErrBodyTooLong       = errors.New("Body longer than its Content-Length.")
+	// ErrIncompleteBody is returned by Finish if fewer bytes were written than
+	// the Content-Length announced
+	ErrIncompleteBody = errors.New("Body shorter than its Content-Length.")
+)
+
+// WriteError is returned by the Writer's methods when they are called out of
+// order, with an invalid status or with a body that doesn't fit the framing.
+// The rejected part is not written, but a status line and headers the call
+// wrote implicitly may be. ErrIncompleteBody is reported after the whole
+// response was written.
+type WriteError struct {
+	// Op is the method that was called, e.g. "WriteHeaders"
+	Op  string
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
@@ -1,93 +1,512 @@
 package response
 
 import (
-	"fmt"
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/PavelVaavra/http-from-tcp/internal/headers"
 )
 
-type StatusCode int
-
-const (
-	StatusCodeOK                  StatusCode = 200
-	StatusCodeBadRequest          StatusCode = 400
-	StatusCodeInternalServerError StatusCode = 500
-)
-
+// Writer writes a response in order: status line, headers, body, and for
+// chunked bodies the trailers. Calls out of order fail with a *WriteError.
+// Writing headers or body first implicitly writes the status line, and
+// headers, that were set so far, defaulting to 200 OK. Output is buffered
+// until Flush or Finish, which the server calls after the handler.
 type Writer struct {
+	// StatusCode defaults to 200, StatusPhrase to StatusText(StatusCode)
 	StatusCode   StatusCode
 	StatusPhrase string
 	Headers      headers.Headers
 	BodyText     string
-	BodyChunked  io.ReadCloser
 	BodyVideo    []byte
 	Trailers     headers.Headers
 	Conn         net.Conn
+	// PreserveHeaderCase writes header and trailer names exactly as they were
+	// set instead of canonicalizing them, for clients that depend on casing.
+	PreserveHeaderCase bool
+	// OmitBody is set by the server for responses to HEAD requests. The status
+	// line and headers are written as usual, body and trailer writes are
+	// dropped.
+	OmitBody bool
+	// HttpVersion is the version of the request being answered. HTTP/1.0
+	// clients don't understand chunked encoding, so chunked bodies are sent
+	// as they are and delimited by closing the connection.
+	HttpVersion string
+	// KeepAlive is set by the server when it intends to reuse the connection.
+	// Otherwise WriteHeaders adds Connection: close.
+	KeepAlive bool
+	// Server is sent as the Server header unless the handler set one. Empty
+	// means no Server header.
+	Server string
+	// WriteHeaders adds a Date header unless the handler set one or OmitDate
+	// is set.
+	OmitDate bool
+	// Bodies of known size, from WriteBody, WriteBodyVideo or what Write held
+	// back, get a Content-Length unless the handler set the framing itself or
+	// OmitContentLength is set. The body is then chunked or, for a single
+	// WriteBody, delimited by closing the connection.
+	OmitContentLength bool
+
+	state writerState
+	// whether the headers announced a chunked body, and the announced
+	// Content-Length or -1
+	chunked       bool
+	contentLength int64
+	// body held back by Write until its length is known
+	pending []byte
+	// buffer in front of Conn, taken from outPool on the first write
+	out *bufio.Writer
+	// status line and body bytes that actually went out
+	writtenStatus StatusCode
+	writtenBytes  int64
+	// whether Finish was called, and what it returned
+	finished  bool
+	finishErr error
 }
 
+// outBufferSize is the size of the buffer collecting the small writes of a
+// response into few writes to the connection
+const outBufferSize = 4 << 10
+
+var outPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, outBufferSize)
+	},
+}
+
+// maxPendingBody is how much of a body Write holds back to give it a
+// Content-Length
+const maxPendingBody = 4 << 10
+
+type writerState int
+
+const (
+	writerStateStatusLine writerState = iota
+	writerStateHeaders
+	writerStateBody
+	writerStateDone
+)
+
 func (w *Writer) WriteStatusLine() error {
+	if w.state != writerStateStatusLine {
+		return &WriteError{Op: "WriteStatusLine", Err: ErrStatusLineWritten}
+	}
+	if w.StatusCode == 0 {
+		w.StatusCode = StatusCodeOK
+	}
+	if w.StatusCode < 100 || w.StatusCode > 999 {
+		return &WriteError{Op: "WriteStatusLine", Err: ErrInvalidStatusCode}
+	}
+	if w.StatusPhrase == "" {
+		w.StatusPhrase = StatusText(w.StatusCode)
+	}
 	statusLine := "HTTP/1.1 " + strconv.Itoa(int(w.StatusCode)) + " " + w.StatusPhrase + "\r\n"
-	_, err := w.Conn.Write([]byte(statusLine))
-	return err
+	_, err := w.write([]byte(statusLine))
+	if err != nil {
+		return err
+	}
+	w.writtenStatus = w.StatusCode
+	w.state = writerStateHeaders
+	return nil
+}
+
+// Committed reports whether the status line was written, after which the
+// response can't be replaced by another one.
+func (w *Writer) Committed() bool {
+	return w.state > writerStateStatusLine
+}
+
+// WrittenStatus returns the status code of the status line written so far,
+// or 0 if none was written.
+func (w *Writer) WrittenStatus() StatusCode {
+	return w.writtenStatus
+}
+
+// WrittenBytes returns the number of body bytes written so far, not counting
+// chunked framing.
+func (w *Writer) WrittenBytes() int64 {
+	return w.writtenBytes
 }
 
+// WriteHeaders writes the headers in the order they were added, followed by
+// the empty line ending the header section.
 func (w *Writer) WriteHeaders() error {
-	for k, v := range w.Headers {
-		header := k + ": " + v + "\r\n"
-		_, err := w.Conn.Write([]byte(header))
+	if w.state == writerStateStatusLine {
+		if err := w.WriteStatusLine(); err != nil {
+			return err
+		}
+	}
+	if w.state != writerStateHeaders {
+		return &WriteError{Op: "WriteHeaders", Err: ErrHeadersWritten}
+	}
+	w.chunked = hasChunked(w.Headers)
+	w.contentLength = -1
+	if length, err := w.Headers.Get("Content-Length"); err == nil {
+		if n, err := strconv.ParseInt(length, 10, 64); err == nil {
+			w.contentLength = n
+		}
+	}
+	w.addAutoHeaders()
+	w.adaptHeaders()
+	for k, v := range w.Headers.All() {
+		header := w.headerName(k) + ": " + v + "\r\n"
+		_, err := w.write([]byte(header))
 		if err != nil {
 			return err
 		}
 	}
-	_, err := w.Conn.Write([]byte("\r\n"))
+	_, err := w.write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
+	w.state = writerStateBody
 	return nil
 }
 
-func (w *Writer) WriteBody() error {
-	_, err := w.Conn.Write([]byte(w.BodyText))
+// startBody writes what is missing before the body, including what Write
+// buffered, and checks that the response isn't finished yet
+func (w *Writer) startBody(op string) error {
+	if w.state == writerStateDone {
+		return &WriteError{Op: op, Err: ErrResponseDone}
+	}
+	if w.state == writerStateBody {
+		return nil
+	}
+	if len(w.pending) > 0 && !hasFraming(w.Headers) {
+		w.Headers.Set("Transfer-Encoding", "chunked")
+	}
+	if err := w.WriteHeaders(); err != nil {
+		return err
+	}
+	pending := w.pending
+	w.pending = nil
+	return w.writeFramed(op, pending)
+}
+
+// startChunkedBody is startBody for chunked writes. If the headers weren't
+// written yet and don't say otherwise, the body becomes chunked.
+func (w *Writer) startChunkedBody(op string) error {
+	if w.state < writerStateBody && !hasFraming(w.Headers) {
+		w.Headers.Set("Transfer-Encoding", "chunked")
+	}
+	if err := w.startBody(op); err != nil {
+		return err
+	}
+	if !w.chunked {
+		return &WriteError{Op: op, Err: ErrNotChunked}
+	}
+	return nil
+}
+
+// writeFramed writes p as part of the body, as a chunk if the body is chunked
+func (w *Writer) writeFramed(op string, p []byte) error {
+	if w.OmitBody || len(p) == 0 {
+		return nil
+	}
+	if w.contentLength >= 0 && w.writtenBytes+int64(len(p)) > w.contentLength {
+		return &WriteError{Op: op, Err: ErrBodyTooLong}
+	}
+	if !w.chunked || w.HttpVersion == "1.0" {
+		n, err := w.write(p)
+		w.writtenBytes += int64(n)
+		return err
+	}
+	if _, err := w.write([]byte(strconv.FormatInt(int64(len(p)), 16) + "\r\n")); err != nil {
+		return err
+	}
+	if _, err := w.write(p); err != nil {
+		return err
+	}
+	_, err := w.write([]byte("\r\n"))
+	if err == nil {
+		w.writtenBytes += int64(len(p))
+	}
 	return err
 }
 
+func (w *Writer) WriteBody() error {
+	w.setContentLength(len(w.BodyText))
+	if err := w.startBody("WriteBody"); err != nil {
+		return err
+	}
+	return w.writeFramed("WriteBody", []byte(w.BodyText))
+}
+
 func (w *Writer) WriteBodyVideo() error {
-	_, err := w.Conn.Write(w.BodyVideo)
-	return err
+	w.setContentLength(len(w.BodyVideo))
+	if err := w.startBody("WriteBodyVideo"); err != nil {
+		return err
+	}
+	return w.writeFramed("WriteBodyVideo", w.BodyVideo)
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) error {
-	chunk := []byte(fmt.Sprintf("%X", len(p)))
-	chunk = append(chunk, []byte("\r\n")...)
-	chunk = append(chunk, p...)
-	chunk = append(chunk, []byte("\r\n")...)
-	_, err := w.Conn.Write(chunk)
+	if err := w.startChunkedBody("WriteChunkedBody"); err != nil {
+		return err
+	}
+	return w.writeFramed("WriteChunkedBody", p)
+}
+
+// Write writes p as part of the body, so the Writer can be used with
+// io.Copy, encoders and templates. If the headers set neither Content-Length
+// nor chunked encoding, up to maxPendingBody bytes are held back: a body that
+// fits gets a Content-Length when the response is finished, a larger one or
+// a Flush makes it chunked.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.state < writerStateBody && !hasFraming(w.Headers) && len(w.pending)+len(p) <= maxPendingBody {
+		w.pending = append(w.pending, p...)
+		return len(p), nil
+	}
+	if w.state < writerStateBody && !hasFraming(w.Headers) {
+		w.Headers.Set("Transfer-Encoding", "chunked")
+	}
+	if err := w.startBody("Write"); err != nil {
+		return 0, err
+	}
+	if err := w.writeFramed("Write", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrom copies r into the body like Write. Once the headers are written
+// and the body isn't chunked, r goes to the connection directly, which lets
+// a file be sent with sendfile. It stops at the announced Content-Length.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.state == writerStateBody && !w.chunked && !w.OmitBody {
+		if w.contentLength >= 0 {
+			r = io.LimitReader(r, w.contentLength-w.writtenBytes)
+		}
+		if err := w.flushOut(); err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(w.Conn, r)
+		w.writtenBytes += n
+		return n, err
+	}
+
+	var written int64
+	buff := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buff)
+		if n > 0 {
+			if _, err := w.Write(buff[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Flush writes the status line, the headers and what Write held back, and
+// sends everything buffered to the client, for handlers that stream. A body
+// without Content-Length becomes chunked.
+func (w *Writer) Flush() error {
+	if w.state < writerStateBody && !hasFraming(w.Headers) {
+		w.Headers.Set("Transfer-Encoding", "chunked")
+	}
+	if w.state != writerStateDone {
+		if err := w.startBody("Flush"); err != nil {
+			return err
+		}
+	}
+	return w.flushOut()
+}
+
+// write buffers p for the connection. The buffer comes from a pool and goes
+// back when Finish flushes it.
+func (w *Writer) write(p []byte) (int, error) {
+	if w.out == nil {
+		w.out = outPool.Get().(*bufio.Writer)
+		w.out.Reset(w.Conn)
+	}
+	return w.out.Write(p)
+}
+
+func (w *Writer) flushOut() error {
+	if w.out == nil {
+		return nil
+	}
+	return w.out.Flush()
+}
+
+// releaseOut flushes the buffer and returns it to the pool
+func (w *Writer) releaseOut() error {
+	if w.out == nil {
+		return nil
+	}
+	err := w.out.Flush()
+	w.out.Reset(nil)
+	outPool.Put(w.out)
+	w.out = nil
 	return err
 }
 
 func (w *Writer) WriteChunkedBodyDone() error {
-	_, err := w.Conn.Write([]byte("0\r\n\r\n"))
+	if err := w.startChunkedBody("WriteChunkedBodyDone"); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	if w.OmitBody || w.HttpVersion == "1.0" {
+		return nil
+	}
+	_, err := w.write([]byte("0\r\n\r\n"))
 	return err
 }
 
 func (w *Writer) WriteTrailers() error {
-	_, err := w.Conn.Write([]byte("0\r\n"))
+	if err := w.startChunkedBody("WriteTrailers"); err != nil {
+		return err
+	}
+	w.state = writerStateDone
+	if w.OmitBody || w.HttpVersion == "1.0" {
+		return nil
+	}
+	_, err := w.write([]byte("0\r\n"))
 	if err != nil {
 		return err
 	}
-	for k, v := range w.Trailers {
-		trailer := k + ": " + v + "\r\n"
-		_, err := w.Conn.Write([]byte(trailer))
+	for k, v := range w.Trailers.All() {
+		trailer := w.headerName(k) + ": " + v + "\r\n"
+		_, err := w.write([]byte(trailer))
 		if err != nil {
 			return err
 		}
 	}
-	_, err = w.Conn.Write([]byte("\r\n"))
+	_, err = w.write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Finish completes the response once the handler is done and sends what is
+// still buffered. A body Write held back is sent with its Content-Length, a
+// response that wasn't started becomes an empty one and a chunked body gets
+// its last chunk. It returns ErrIncompleteBody if the body fell short of its
+// Content-Length, the connection can't be reused then. Later calls return
+// the result of the first one.
+func (w *Writer) Finish() error {
+	if w.finished {
+		return w.finishErr
+	}
+	err := w.finish()
+	if flushErr := w.releaseOut(); err == nil {
+		err = flushErr
+	}
+	w.finished, w.finishErr = true, err
+	return err
+}
+
+// Abort ends a response that can't be completed, e.g. after a handler
+// panicked. What was written so far is sent as it is, the caller has to close
+// the connection so the client notices.
+func (w *Writer) Abort() error {
+	w.state = writerStateDone
+	return w.releaseOut()
+}
+
+func (w *Writer) finish() error {
+	// a HEAD handler that wrote nothing leaves the length unknown, not 0
+	if !w.OmitBody || len(w.pending) > 0 {
+		w.setContentLength(0)
+	}
+	if err := w.startBody("Finish"); err != nil {
+		if errors.Is(err, ErrResponseDone) {
+			return nil
+		}
+		return err
+	}
+	if w.chunked {
+		return w.WriteChunkedBodyDone()
+	}
+	w.state = writerStateDone
+	if !w.OmitBody && hasBody(w.StatusCode) && w.contentLength > w.writtenBytes {
+		return &WriteError{Op: "Finish", Err: ErrIncompleteBody}
+	}
+	return nil
+}
+
+// setContentLength announces a body of n bytes following what Write held
+// back, if the headers aren't written yet and leave the framing open. 1xx,
+// 204 and 304 responses get none, they have no body.
+func (w *Writer) setContentLength(n int) {
+	if w.state < writerStateBody && !hasFraming(w.Headers) && !w.OmitContentLength && hasBody(w.StatusCode) {
+		w.Headers.Set("Content-Length", strconv.Itoa(len(w.pending)+n))
+	}
+}
+
+// addAutoHeaders adds the Date and Server headers the handler didn't set
+func (w *Writer) addAutoHeaders() {
+	if _, err := w.Headers.Get("Date"); err != nil && !w.OmitDate {
+		w.Headers.Set("Date", date(now()))
+	}
+	if _, err := w.Headers.Get("Server"); err != nil && w.Server != "" {
+		w.Headers.Set("Server", w.Server)
+	}
+}
+
+// adaptHeaders fits the headers to the request's HTTP version and sets the
+// Connection header
+func (w *Writer) adaptHeaders() {
+	keepAlive := w.KeepAlive
+	if w.HttpVersion == "1.0" {
+		w.Headers.Del("Transfer-Encoding")
+		w.Headers.Del("Trailer")
+	}
+	if w.CloseDelimited() {
+		keepAlive = false
+	}
+	if !keepAlive {
+		w.Headers.Set("Connection", "close")
+		return
+	}
+	if _, err := w.Headers.Get("Connection"); err != nil && w.HttpVersion == "1.0" {
+		w.Headers.Set("Connection", "keep-alive")
+	}
+}
+
+// CloseDelimited reports whether the body has neither Content-Length nor
+// chunked framing, so that it can only end by closing the connection
+func (w *Writer) CloseDelimited() bool {
+	_, errLength := w.Headers.Get("Content-Length")
+	return errLength != nil && !hasChunked(w.Headers) && !w.OmitBody && hasBody(w.StatusCode)
+}
+
+// hasBody reports whether responses with the status code can have a body, 0
+// stands for the default 200
+func hasBody(code StatusCode) bool {
+	if code == 0 {
+		return true
+	}
+	return code >= 200 && code != StatusCodeNoContent && code != StatusCodeNotModified
+}
+
+// hasFraming reports whether the headers say how the body ends
+func hasFraming(h headers.Headers) bool {
+	_, err := h.Get("Content-Length")
+	return err == nil || hasChunked(h)
+}
+
+func hasChunked(h headers.Headers) bool {
+	transferEncoding, _ := h.Get("Transfer-Encoding")
+	return strings.Contains(strings.ToLower(transferEncoding), "chunked")
+}
+
+func (w *Writer) headerName(key string) string {
+	if w.PreserveHeaderCase {
+		return key
+	}
+	return headers.CanonicalKey(key)
+}
@@ -0,0 +1,396 @@
+package response
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingConn is a net.Conn counting the writes, each of which would be a
+// syscall on a real connection
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return len(p), nil
+}
+
+// bufferConn is a net.Conn that records everything written to it
+type bufferConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: Canonical names in insertion order
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	w.Headers.Set("content-type", "text/plain")
+	w.Headers.Set("CONTENT-LENGTH", "5")
+	w.Headers.Add("set-cookie", "a=1")
+	w.Headers.Add("Set-Cookie", "b=2")
+	require.NoError(t, w.WriteHeaders())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"\r\n", conn.written.String())
+
+	// Test: Caller-provided casing preserved
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, PreserveHeaderCase: true}
+	w.Headers.Set("content-type", "text/plain")
+	w.Headers.Set("X-Content-SHA256", "abc")
+	w.Headers.Set("content-length", "0")
+	require.NoError(t, w.WriteHeaders())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"content-type: text/plain\r\n"+
+		"X-Content-SHA256: abc\r\n"+
+		"content-length: 0\r\n"+
+		"\r\n", conn.written.String())
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: Chunked body sent close-delimited
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true, HttpVersion: "1.0"}
+	w.Headers.Set("Transfer-Encoding", "chunked")
+	w.Headers.Set("Trailer", "X-Content-Length")
+	w.Trailers.Set("X-Content-Length", "5")
+	require.NoError(t, w.WriteHeaders())
+	require.NoError(t, w.WriteChunkedBody([]byte("hello")))
+	require.NoError(t, w.WriteTrailers())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", conn.written.String())
+
+	// Test: Keep-alive announced for a Content-Length body
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, HttpVersion: "1.0"}
+	w.Headers.Set("Content-Length", "0")
+	require.NoError(t, w.WriteHeaders())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n", conn.written.String())
+}
+
+func TestWriteOrder(t *testing.T) {
+	// Test: The first body write sends a default status line and the headers
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	w.Headers.Set("Content-Length", "5")
+	assert.False(t, w.Committed())
+	w.BodyText = "hello"
+	require.NoError(t, w.WriteBody())
+	assert.True(t, w.Committed())
+	assert.Equal(t, StatusCodeOK, w.WrittenStatus())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", conn.written.String())
+
+	// Test: Going back is rejected without writing
+	err := w.WriteStatusLine()
+	require.ErrorIs(t, err, ErrStatusLineWritten)
+	var writeErr *WriteError
+	require.ErrorAs(t, err, &writeErr)
+	assert.Equal(t, "WriteStatusLine", writeErr.Op)
+	require.ErrorIs(t, w.WriteHeaders(), ErrHeadersWritten)
+	require.ErrorIs(t, w.WriteChunkedBody([]byte("x")), ErrNotChunked)
+	require.NoError(t, w.Finish())
+	require.ErrorIs(t, w.WriteBody(), ErrResponseDone)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", conn.written.String())
+
+	// Test: Chunked writes pick chunked framing, Finish ends the body
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, StatusCode: StatusCodeNotFound, StatusPhrase: "Not Found"}
+	require.NoError(t, w.WriteChunkedBody([]byte("hello")))
+	require.NoError(t, w.Finish())
+	require.ErrorIs(t, w.WriteTrailers(), ErrResponseDone)
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", conn.written.String())
+
+	// Test: Finish sends an empty response if nothing was written
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", conn.written.String())
+
+	// Test: Finish reports a body shorter than announced
+	w = Writer{Conn: &bufferConn{}, OmitDate: true, KeepAlive: true}
+	w.Headers.Set("Content-Length", "10")
+	w.BodyText = "short"
+	require.NoError(t, w.WriteBody())
+	require.ErrorIs(t, w.Finish(), ErrIncompleteBody)
+	require.ErrorIs(t, w.Finish(), ErrIncompleteBody)
+}
+
+func TestWrite(t *testing.T) {
+	// Test: A small body gets a Content-Length
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	w.Headers.Set("Content-Type", "application/json")
+	require.NoError(t, json.NewEncoder(&w).Encode(map[string]int{"a": 1}))
+	assert.False(t, w.Committed())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 8\r\n\r\n{\"a\":1}\n", conn.written.String())
+
+	// Test: A large body is chunked
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	body := strings.Repeat("x", maxPendingBody+1)
+	n, err := io.Copy(&w, strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, fmt.Sprintf("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n%X\r\n%s\r\n0\r\n\r\n", len(body), body), conn.written.String())
+	assert.Equal(t, int64(len(body)), w.WrittenBytes())
+
+	// Test: Flush sends what was held back as a chunk
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	fmt.Fprint(&w, "data: 1\n\n")
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n9\r\ndata: 1\n\n\r\n", conn.written.String())
+
+	// Test: With a Content-Length the body goes out as it is and can't exceed it
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	w.Headers.Set("Content-Length", "5")
+	n, err = w.ReadFrom(strings.NewReader("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	_, err = w.Write([]byte("!"))
+	require.ErrorIs(t, err, ErrBodyTooLong)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", conn.written.String())
+
+	// Test: HEAD responses get the length without the body
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, OmitBody: true}
+	fmt.Fprint(&w, "hello")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", conn.written.String())
+}
+
+func TestAbort(t *testing.T) {
+	// Test: Abort sends what was written without completing the body
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	require.NoError(t, w.WriteChunkedBody([]byte("hello")))
+	require.NoError(t, w.Abort())
+	require.ErrorIs(t, w.WriteChunkedBodyDone(), ErrResponseDone)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", conn.written.String())
+}
+
+func TestBufferedWrites(t *testing.T) {
+	// Test: Status line, headers and small chunks go out in one write
+	conn := &countingConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true}
+	for i := range 10 {
+		w.Headers.Set(fmt.Sprintf("X-Header-%d", i), "value")
+	}
+	require.NoError(t, w.WriteChunkedBody([]byte("hello")))
+	require.NoError(t, w.WriteChunkedBody([]byte("world")))
+	assert.Equal(t, 0, conn.writes)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 1, conn.writes)
+}
+
+// writeUnbuffered writes a chunked response the way Writer did before it
+// buffered, with a connection write per line and chunk
+func writeUnbuffered(conn net.Conn, h headers.Headers, chunks [][]byte) {
+	conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
+	for k, v := range h.All() {
+		conn.Write([]byte(k + ": " + v + "\r\n"))
+	}
+	conn.Write([]byte("\r\n"))
+	for _, p := range chunks {
+		chunk := []byte(fmt.Sprintf("%X\r\n", len(p)))
+		chunk = append(chunk, p...)
+		chunk = append(chunk, "\r\n"...)
+		conn.Write(chunk)
+	}
+	conn.Write([]byte("0\r\n\r\n"))
+}
+
+func BenchmarkWriteResponse(b *testing.B) {
+	h := headers.Headers{}
+	for i := range 10 {
+		h.Set(fmt.Sprintf("X-Header-%d", i), "value")
+	}
+	h.Set("Transfer-Encoding", "chunked")
+	chunks := make([][]byte, 8)
+	for i := range chunks {
+		chunks[i] = bytes.Repeat([]byte("x"), 256)
+	}
+
+	b.Run("unbuffered", func(b *testing.B) {
+		conn := &countingConn{}
+		b.ReportAllocs()
+		for range b.N {
+			writeUnbuffered(conn, h, chunks)
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("buffered", func(b *testing.B) {
+		conn := &countingConn{}
+		b.ReportAllocs()
+		for range b.N {
+			w := Writer{Conn: conn, OmitDate: true, KeepAlive: true, Headers: h.Clone()}
+			for _, p := range chunks {
+				w.WriteChunkedBody(p)
+			}
+			w.Finish()
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+}
+
+func TestStatusLine(t *testing.T) {
+	assert.Equal(t, "Not Found", StatusText(StatusCodeNotFound))
+	assert.Equal(t, "Unprocessable Content", StatusText(422))
+	assert.Equal(t, "", StatusText(299))
+
+	tests := []struct {
+		code   StatusCode
+		phrase string
+		want   string
+	}{
+		{StatusCodeNotFound, "", "HTTP/1.1 404 Not Found\r\n"},
+		{StatusCodeServiceUnavailable, "", "HTTP/1.1 503 Service Unavailable\r\n"},
+		{StatusCodeOK, "Woopsie", "HTTP/1.1 200 Woopsie\r\n"},
+		{0, "", "HTTP/1.1 200 OK\r\n"},
+		{299, "", "HTTP/1.1 299 \r\n"},
+	}
+	for _, tt := range tests {
+		conn := &bufferConn{}
+		w := Writer{Conn: conn, StatusCode: tt.code, StatusPhrase: tt.phrase}
+		require.NoError(t, w.WriteStatusLine())
+		require.NoError(t, w.Abort())
+		assert.Equal(t, tt.want, conn.written.String())
+	}
+
+	// Test: Codes without three digits are rejected
+	for _, code := range []StatusCode{99, 1000, -200} {
+		w := Writer{Conn: &bufferConn{}, StatusCode: code}
+		require.ErrorIs(t, w.WriteStatusLine(), ErrInvalidStatusCode)
+		assert.False(t, w.Committed())
+	}
+}
+
+func TestAutomaticHeaders(t *testing.T) {
+	defer func(orig func() time.Time) { now = orig }(now)
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 5, 3, 0, time.FixedZone("CEST", 2*60*60)) }
+
+	// Test: Date, Server and the Content-Length of a known body
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, KeepAlive: true, Server: "http-from-tcp"}
+	w.BodyText = "hello"
+	require.NoError(t, w.WriteBody())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Length: 5\r\n"+
+		"Date: Sun, 18 Oct 2026 07:05:03 GMT\r\n"+
+		"Server: http-from-tcp\r\n"+
+		"\r\nhello", conn.written.String())
+
+	// Test: Headers set by the handler win
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, KeepAlive: true, Server: "http-from-tcp"}
+	w.Headers.Set("Server", "custom")
+	w.Headers.Set("Date", "Thu, 01 Jan 1970 00:00:00 GMT")
+	w.Headers.Set("Transfer-Encoding", "chunked")
+	w.BodyText = "hello"
+	require.NoError(t, w.WriteBody())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Server: custom\r\n"+
+		"Date: Thu, 01 Jan 1970 00:00:00 GMT\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n5\r\nhello\r\n0\r\n\r\n", conn.written.String())
+
+	// Test: Each header can be suppressed, the body is then delimited by
+	// closing the connection
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, KeepAlive: true, OmitDate: true, OmitContentLength: true}
+	w.BodyText = "hello"
+	require.NoError(t, w.WriteBody())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", conn.written.String())
+
+	// Test: Bodies held back by Write become chunked without Content-Length
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, KeepAlive: true, OmitDate: true, OmitContentLength: true}
+	fmt.Fprint(&w, "hello")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", conn.written.String())
+}
+
+func TestDate(t *testing.T) {
+	start := time.Date(2026, 10, 18, 7, 5, 3, 0, time.UTC)
+
+	// Test: Formatted once per second
+	first := date(start)
+	assert.Equal(t, "Sun, 18 Oct 2026 07:05:03 GMT", first)
+	cached := dateCache.Load()
+	assert.Equal(t, first, date(start.Add(999*time.Millisecond)))
+	assert.Same(t, cached, dateCache.Load())
+
+	// Test: The next second is formatted again
+	assert.Equal(t, "Sun, 18 Oct 2026 07:05:04 GMT", date(start.Add(time.Second)))
+	assert.NotSame(t, cached, dateCache.Load())
+}
+
+func TestBodylessStatus(t *testing.T) {
+	// Test: No Content-Length for statuses without a body, the connection
+	// stays open
+	for _, code := range []StatusCode{StatusCodeContinue, StatusCodeNoContent, StatusCodeNotModified} {
+		conn := &bufferConn{}
+		w := Writer{Conn: conn, OmitDate: true, KeepAlive: true, StatusCode: code}
+		require.NoError(t, w.Finish())
+		assert.Equal(t, fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", code, StatusText(code)), conn.written.String())
+	}
+
+	// Test: A 304 may carry the length of the resource
+	conn := &bufferConn{}
+	w := Writer{Conn: conn, OmitDate: true, KeepAlive: true, StatusCode: StatusCodeNotModified}
+	w.Headers.Set("Content-Length", "42")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 42\r\n\r\n", conn.written.String())
+
+	// Test: HEAD keeps the length the handler supplied and gets none if it
+	// wrote nothing
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, OmitBody: true}
+	w.Headers.Set("Content-Length", "42")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n", conn.written.String())
+
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, OmitBody: true}
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", conn.written.String())
+
+	// Test: HEAD still gets the length of a body written and dropped
+	conn = &bufferConn{}
+	w = Writer{Conn: conn, OmitDate: true, KeepAlive: true, OmitBody: true}
+	w.BodyText = "hello"
+	require.NoError(t, w.WriteBody())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", conn.written.String())
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Config holds the tunables of a Server. Zero values are replaced with the
+// defaults, negative limits and timeouts disable them.
+type Config struct {
+	// Addr is the TCP address Listen binds, e.g. ":8080" or "127.0.0.1:0"
+	Addr    string
+	Handler Handler
+	// IdleTimeout is how long a keep-alive connection may wait for the next request
+	IdleTimeout time.Duration
+	// ReadHeaderTimeout limits reading the request line and headers once a request has started
+	ReadHeaderTimeout time.Duration
+	// ReadBodyTimeout limits how long a single body read may wait for data
+	ReadBodyTimeout time.Duration
+	// WriteTimeout limits the time from the end of the request headers to the
+	// end of the response. There is no default since it also cuts off long
+	// downloads.
+	WriteTimeout time.Duration
+	// HandlerTimeout cancels the request's context after the given time
+	HandlerTimeout time.Duration
+	// StreamBodies hands request bodies to handlers unbuffered through Request.BodyReader
+	StreamBodies bool
+	// Methods lists the methods Handler implements. Other methods are answered
+	// with 501 Not Implemented without calling Handler.
+	Methods []string
+	// MaxRequestsPerConn is the number of requests served on one connection before it is closed
+	MaxRequestsPerConn int
+	// MaxRequestLineBytes, MaxHeaderBytes and MaxBodyBytes limit the parts of a
+	// request, larger requests get 414, 431 and 413. With StreamBodies there
+	// is no default body limit, since streamed uploads may be large, but one
+	// set explicitly applies.
+	MaxRequestLineBytes int
+	MaxHeaderBytes      int
+	MaxBodyBytes        int
+	// MaxConns limits the number of connections served at once. Further
+	// connections wait in the listener's backlog.
+	MaxConns int
+	// TLSConfig turns on HTTPS. It needs a certificate, e.g. from
+	// Certificates.TLSConfig.
+	TLSConfig *tls.Config
+	// ClientAuth asks TLS clients for a certificate signed by one of
+	// ClientCAs. The verified chain is in Request.TLS.VerifiedChains.
+	ClientAuth ClientAuth
+	ClientCAs  *x509.CertPool
+	// TrustedProxies lists the networks of the proxies in front of the server.
+	// Only requests from them may set the client address with
+	// X-Forwarded-For.
+	TrustedProxies []netip.Prefix
+	// ServerHeader is sent as the Server header of every response whose
+	// handler didn't set one, e.g. "http-from-tcp". Empty means none.
+	ServerHeader string
+	// ErrorLog receives accept, parse and handler errors. Nil means the
+	// standard logger.
+	ErrorLog *log.Logger
+}
+
+// withDefaults returns a copy of c with zero values replaced by the defaults
+// and negative ones by zero, which the server treats as no limit.
+func (c Config) withDefaults() Config {
+	c.IdleTimeout = durationOr(c.IdleTimeout, defaultIdleTimeout)
+	c.ReadHeaderTimeout = durationOr(c.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	c.ReadBodyTimeout = durationOr(c.ReadBodyTimeout, defaultReadBodyTimeout)
+	c.WriteTimeout = durationOr(c.WriteTimeout, 0)
+	c.HandlerTimeout = durationOr(c.HandlerTimeout, 0)
+	c.MaxRequestsPerConn = intOr(c.MaxRequestsPerConn, defaultMaxRequestsPerConn)
+	c.MaxRequestLineBytes = intOr(c.MaxRequestLineBytes, defaultMaxRequestLineBytes)
+	c.MaxHeaderBytes = intOr(c.MaxHeaderBytes, defaultMaxHeaderBytes)
+	if c.StreamBodies {
+		c.MaxBodyBytes = intOr(c.MaxBodyBytes, 0)
+	} else {
+		c.MaxBodyBytes = intOr(c.MaxBodyBytes, defaultMaxBodyBytes)
+	}
+	c.MaxConns = intOr(c.MaxConns, 0)
+	if c.Methods == nil {
+		c.Methods = defaultMethods
+	}
+	return c
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return max(d, 0)
+}
+
+func intOr(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return max(n, 0)
+}
+
+// deadline returns the deadline for a timeout, or no deadline if it is zero
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// validate rejects configurations that would serve less securely than they
+// ask for
+func (c Config) validate() error {
+	if c.ClientAuth == NoClientCert {
+		return nil
+	}
+	if c.TLSConfig == nil {
+		return errors.New("ClientAuth needs a TLSConfig.")
+	}
+	// without CAs crypto/tls accepts any certificate of the system roots
+	if c.ClientCAs == nil && c.TLSConfig.ClientCAs == nil {
+		return errors.New("ClientAuth needs ClientCAs.")
+	}
+	return nil
+}
+
+// Listen binds cfg.Addr over TCP and serves it with cfg
+func Listen(cfg Config) (*Server, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(l, cfg), nil
+}
+
+// NewServer starts serving connections accepted from l, which can be any
+// listener, e.g. a Unix socket or one inherited through socket activation.
+// The server owns l and closes it on Close or Shutdown. With cfg.TLSConfig
+// set, l is expected to accept plain connections that the server wraps. It
+// panics if cfg asks for client certificates without TLS or CAs to verify
+// them.
+func NewServer(l net.Listener, cfg Config) *Server {
+	if err := cfg.validate(); err != nil {
+		panic(err)
+	}
+	if cfg.TLSConfig != nil {
+		if cfg.ClientAuth != NoClientCert {
+			cfg.TLSConfig = clientAuthConfig(cfg.TLSConfig, cfg.ClientAuth, cfg.ClientCAs)
+		}
+		l = tls.NewListener(l, cfg.TLSConfig)
+	}
+	s := &Server{
+		Config:   cfg.withDefaults(),
+		Listener: l,
+		conns:    map[net.Conn]bool{},
+	}
+	if s.MaxConns > 0 {
+		s.sem = make(chan struct{}, s.MaxConns)
+	}
+	s.baseCtx, s.cancelBase = context.WithCancelCause(context.Background())
+	s.State.Store(true)
+	go s.listen()
+	return s
+}
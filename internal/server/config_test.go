@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := Config{IdleTimeout: -1, MaxBodyBytes: 1 << 10}.withDefaults()
+	assert.Equal(t, time.Duration(0), cfg.IdleTimeout)
+	assert.Equal(t, defaultReadHeaderTimeout, cfg.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), cfg.WriteTimeout)
+	assert.Equal(t, 1<<10, cfg.MaxBodyBytes)
+	assert.Equal(t, defaultMaxHeaderBytes, cfg.MaxHeaderBytes)
+	assert.Equal(t, 0, cfg.MaxConns)
+	assert.Equal(t, defaultMethods, cfg.Methods)
+
+	// Test: Streamed bodies have no default limit
+	assert.Equal(t, defaultMaxBodyBytes, Config{}.withDefaults().MaxBodyBytes)
+	assert.Equal(t, 0, Config{StreamBodies: true}.withDefaults().MaxBodyBytes)
+	assert.Equal(t, 1<<10, Config{StreamBodies: true, MaxBodyBytes: 1 << 10}.withDefaults().MaxBodyBytes)
+}
+
+func TestNewServer(t *testing.T) {
+	// Test: Serving a Unix socket listener with a custom error log
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "http.sock"))
+	require.NoError(t, err)
+	var logs bytes.Buffer
+	s := NewServer(l, Config{Handler: textHandler, ErrorLog: log.New(&logs, "", 0)})
+	defer s.Close()
+
+	resp := roundTrip(t, s, "GET /first HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/first", resp)
+
+	resp = roundTrip(t, s, "GET / HTTP/1.1\r\nBad Header\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", resp)
+	assert.Contains(t, logs.String(), "could not parse HTTP request")
+}
+
+func TestMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	s, err := Listen(Config{
+		Addr:     "127.0.0.1:0",
+		MaxConns: 1,
+		Handler: func(w *response.Writer, req *request.Request) {
+			<-release
+			textHandler(w, req)
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	first, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer first.Close()
+	first.Write([]byte("GET /first HTTP/1.1\r\nConnection: close\r\n\r\n"))
+
+	// Test: The second connection waits until the first one is done
+	second := make(chan string)
+	go func() {
+		second <- roundTrip(t, s, "GET /secnd HTTP/1.1\r\nConnection: close\r\n\r\n")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-second:
+		t.Fatal("second connection served while the first one was active")
+	default:
+	}
+	close(release)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/secnd", <-second)
+}
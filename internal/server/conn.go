@@ -0,0 +1,50 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// watchedConn lets the server notice a client going away while a handler
+// runs, without losing the bytes of a pipelined request that arrive
+// meanwhile.
+type watchedConn struct {
+	net.Conn
+	// bytes read by the background read, returned by the next Read
+	pending []byte
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// watch reads from the connection in the background and calls gone if the
+// client closed it. Nothing else may read from c until stop is called.
+func (c *watchedConn) watch(gone func()) (stop func()) {
+	done := make(chan struct{})
+	buff := make([]byte, 1)
+	go func() {
+		defer close(done)
+		n, err := c.Conn.Read(buff)
+		if n > 0 {
+			c.pending = append(c.pending, buff[:n]...)
+			return
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			gone()
+		}
+	}()
+	return func() {
+		// a deadline in the past makes the background read return at once
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/headers"
+)
+
+// clientAddr returns the address of the client behind peer. The
+// X-Forwarded-For header is only believed if peer is a trusted proxy, and only
+// as far back as the chain of trusted proxies goes: the last untrusted address
+// is the client, anything before it could be made up.
+func clientAddr(peer net.Addr, h headers.Headers, trusted []netip.Prefix) net.Addr {
+	ip, ok := addrIP(peer)
+	if !ok || !isTrusted(ip, trusted) {
+		return peer
+	}
+	forwarded := h.Values("x-forwarded-for")
+	var hops []string
+	for _, v := range forwarded {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := peer
+	for _, hop := range slices.Backward(hops) {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hop))
+		if err != nil {
+			// malformed entries end the chain we can vouch for
+			return client
+		}
+		client = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), 0))
+		if !isTrusted(ip, trusted) {
+			return client
+		}
+	}
+	return client
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	return ip.Unmap(), ok
+}
+
+func isTrusted(ip netip.Addr, trusted []netip.Prefix) bool {
+	return slices.ContainsFunc(trusted, func(p netip.Prefix) bool {
+		return p.Contains(ip.Unmap())
+	})
+}
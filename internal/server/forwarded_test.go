@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAddr(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	proxy := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	stranger := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 4000}
+	forwarded := func(values ...string) headers.Headers {
+		h := headers.Headers{}
+		for _, v := range values {
+			h.Add("X-Forwarded-For", v)
+		}
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		peer    net.Addr
+		headers headers.Headers
+		want    string
+	}{
+		{"no header", proxy, forwarded(), "10.0.0.1:4000"},
+		{"untrusted peer", stranger, forwarded("198.51.100.1"), "203.0.113.9:4000"},
+		{"trusted peer", proxy, forwarded("198.51.100.1"), "198.51.100.1:0"},
+		{"spoofed prefix", proxy, forwarded("1.2.3.4, 198.51.100.1, 10.0.0.2"), "198.51.100.1:0"},
+		{"multiple fields", proxy, forwarded("1.2.3.4", "198.51.100.1"), "198.51.100.1:0"},
+		{"all trusted", proxy, forwarded("10.0.0.3"), "10.0.0.3:0"},
+		{"malformed", proxy, forwarded("198.51.100.1, junk"), "10.0.0.1:4000"},
+		{"ipv6 peer", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1}, forwarded("2001:db8::1"), "[2001:db8::1]:0"},
+		{"unix socket", &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, forwarded("198.51.100.1"), "/tmp/s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, clientAddr(tt.peer, tt.headers, trusted).String())
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+)
+
+// Middleware wraps a Handler with cross-cutting behavior such as logging,
+// authentication or timing. It can inspect the request before calling next
+// and the response.Writer's WrittenStatus and WrittenBytes after.
+type Middleware func(next Handler) Handler
+
+// Chain composes middlewares into one. The first middleware is the outermost,
+// so it sees the request first and the response last. The response is
+// finished when the wrapped handler returns, so middlewares observe what is
+// actually sent even if the handler only set a status.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		handler := next
+		next = func(w *response.Writer, req *request.Request) {
+			handler(w, req)
+			w.Finish()
+		}
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
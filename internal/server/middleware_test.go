@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a middleware that appends what it observes to log
+func recorder(name string, log *[]string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			*log = append(*log, name+" before")
+			next(w, req)
+			*log = append(*log, fmt.Sprintf("%s after %d %d", name, w.WrittenStatus(), w.WrittenBytes()))
+		}
+	}
+}
+
+// discardConn is a net.Conn that drops everything written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestChain(t *testing.T) {
+	var log []string
+	handler := Chain(recorder("outer", &log), recorder("inner", &log))(func(w *response.Writer, req *request.Request) {
+		log = append(log, "handler")
+	})
+	handler(&response.Writer{Conn: discardConn{}}, &request.Request{})
+	assert.Equal(t, []string{"outer before", "inner before", "handler", "inner after 200 0", "outer after 200 0"}, log)
+
+	// Test: A status set without writing is observed as written
+	log = nil
+	handler = Chain(recorder("outer", &log))(func(w *response.Writer, req *request.Request) {
+		w.StatusCode = response.StatusCodeNotFound
+	})
+	handler(&response.Writer{Conn: discardConn{}}, &request.Request{})
+	assert.Equal(t, []string{"outer before", "outer after 404 0"}, log)
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var log []string
+	router := NewRouter()
+	router.Use(recorder("router", &log))
+	router.Handle("GET /videos/{id}", nameHandler("video"), recorder("route", &log))
+	router.Handle("GET /broken", func(w *response.Writer, req *request.Request) {
+		w.StatusCode = response.StatusCodeInternalServerError
+	})
+	s, err := Serve(0, router.ServeRequest)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Route and router middleware observe the written response
+	roundTrip(t, s, "GET /videos/42 HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, []string{"router before", "route before", "route after 200 11", "router after 200 11"}, log)
+
+	// Test: Router middleware wraps 404 responses
+	log = nil
+	roundTrip(t, s, "GET /missing HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, []string{"router before", "router after 404 0"}, log)
+
+	// Test: A handler that only sets a status is observed with it
+	log = nil
+	resp := roundTrip(t, s, "GET /broken HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, []string{"router before", "router after 500 0"}, log)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", resp)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+)
+
+// ClientAuth says whether TLS clients have to present a certificate
+type ClientAuth int
+
+const (
+	// NoClientCert doesn't ask clients for a certificate
+	NoClientCert ClientAuth = iota
+	// OptionalClientCert verifies a certificate if the client sends one, routes
+	// can still insist with RequireClientCert
+	OptionalClientCert
+	// RequiredClientCert fails the handshake without a verified certificate
+	RequiredClientCert
+)
+
+func (a ClientAuth) tlsType() tls.ClientAuthType {
+	switch a {
+	case OptionalClientCert:
+		return tls.VerifyClientCertIfGiven
+	case RequiredClientCert:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// LoadCertPool reads PEM encoded CA certificates, e.g. for Config.ClientCAs
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates in " + file + ".")
+		}
+	}
+	return pool, nil
+}
+
+// clientAuthConfig returns a copy of cfg verifying client certificates
+// against pool, or against cfg's own ClientCAs if pool is nil
+func clientAuthConfig(cfg *tls.Config, auth ClientAuth, pool *x509.CertPool) *tls.Config {
+	cfg = cfg.Clone()
+	cfg.ClientAuth = auth.tlsType()
+	if pool != nil {
+		cfg.ClientCAs = pool
+	}
+	return cfg
+}
+
+// RequireClientCert returns a middleware answering 403 Forbidden unless the
+// client presented a verified certificate. If names are given, the
+// certificate's subject common name, DNS, email or URI names must contain one
+// of them.
+func RequireClientCert(names ...string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			cert := req.PeerCertificate()
+			if cert == nil || (len(names) > 0 && !hasCertName(cert, names)) {
+				writeEmpty(w, response.StatusCodeForbidden)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+// hasCertName reports whether the certificate was issued to one of names
+func hasCertName(cert *x509.Certificate, names []string) bool {
+	certNames := []string{cert.Subject.CommonName}
+	certNames = append(certNames, cert.DNSNames...)
+	certNames = append(certNames, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		certNames = append(certNames, uri.String())
+	}
+	for _, name := range certNames {
+		if slices.ContainsFunc(names, func(allowed string) bool { return strings.EqualFold(name, allowed) }) {
+			return true
+		}
+	}
+	return false
+}
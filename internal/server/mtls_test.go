@@ -0,0 +1,153 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsRoundTrip is roundTrip over TLS, presenting clientCert if it's not nil
+func tlsRoundTrip(t *testing.T, s *Server, clientCert *tls.Certificate, raw string) (string, error) {
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := tls.Dial("tcp", s.Listener.Addr().String(), cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		return "", err
+	}
+	resp, err := io.ReadAll(conn)
+	return stripDate(string(resp)), err
+}
+
+func TestClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certs := NewCertificates()
+	require.NoError(t, certs.Add(writeCert(t, dir, 1, "localhost")))
+	opsCertFile, opsKeyFile := writeCert(t, dir, 2, "ops.internal")
+	devCertFile, devKeyFile := writeCert(t, dir, 3, "dev.internal", "dev@example.com")
+	pool, err := LoadCertPool(opsCertFile, devCertFile)
+	require.NoError(t, err)
+	opsCert, err := tls.LoadX509KeyPair(opsCertFile, opsKeyFile)
+	require.NoError(t, err)
+	devCert, err := tls.LoadX509KeyPair(devCertFile, devKeyFile)
+	require.NoError(t, err)
+
+	router := NewRouter()
+	router.Handle("GET /public", nameHandler("public"))
+	router.Handle("GET /any", nameHandler("any"), RequireClientCert())
+	router.Handle("GET /admin", nameHandler("admin"), RequireClientCert("ops.internal", "admin@example.com"))
+
+	s, err := Listen(Config{
+		Addr:       "127.0.0.1:0",
+		Handler:    router.ServeRequest,
+		TLSConfig:  certs.TLSConfig(),
+		ClientAuth: OptionalClientCert,
+		ClientCAs:  pool,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	get := func(cert *tls.Certificate, path string) string {
+		resp, err := tlsRoundTrip(t, s, cert, "GET "+path+" HTTP/1.1\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err)
+		status, _, _ := strings.Cut(resp, "\r\n")
+		return status
+	}
+
+	// Test: Without a certificate only the open route is served
+	assert.Equal(t, "HTTP/1.1 200 OK", get(nil, "/public"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", get(nil, "/any"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", get(nil, "/admin"))
+
+	// Test: Routes check the certificate's names
+	assert.Equal(t, "HTTP/1.1 200 OK", get(&opsCert, "/admin"))
+	assert.Equal(t, "HTTP/1.1 200 OK", get(&devCert, "/any"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden", get(&devCert, "/admin"))
+
+	// Test: Unknown certificates fail the handshake
+	_, err = tlsRoundTrip(t, s, certs.certs[0], "GET /public HTTP/1.1\r\n\r\n")
+	require.Error(t, err)
+}
+
+func TestRequiredClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certs := NewCertificates()
+	require.NoError(t, certs.Add(writeCert(t, dir, 1, "localhost")))
+	clientCertFile, clientKeyFile := writeCert(t, dir, 2, "ops.internal")
+	pool, err := LoadCertPool(clientCertFile)
+	require.NoError(t, err)
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	require.NoError(t, err)
+
+	var peer string
+	s, err := Listen(Config{
+		Addr: "127.0.0.1:0",
+		Handler: func(w *response.Writer, req *request.Request) {
+			peer = req.PeerCertificate().Subject.CommonName
+			writeEmpty(w, response.StatusCodeOK)
+		},
+		TLSConfig:  certs.TLSConfig(),
+		ClientAuth: RequiredClientCert,
+		ClientCAs:  pool,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: The handler sees the verified peer
+	resp, err := tlsRoundTrip(t, s, &clientCert, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", resp)
+	assert.Equal(t, "ops.internal", peer)
+
+	// Test: Clients without a certificate are refused
+	_, err = tlsRoundTrip(t, s, nil, "GET / HTTP/1.1\r\n\r\n")
+	require.Error(t, err)
+
+	_, err = LoadCertPool(filepath.Join(t.TempDir(), "missing.pem"))
+	require.Error(t, err)
+}
+
+func TestClientAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	certs := NewCertificates()
+	require.NoError(t, certs.Add(writeCert(t, dir, 1, "localhost")))
+	clientCertFile, _ := writeCert(t, dir, 2, "ops.internal")
+	pool, err := LoadCertPool(clientCertFile)
+	require.NoError(t, err)
+
+	// Test: Client certificates without CAs would trust the system roots
+	_, err = Listen(Config{Addr: "127.0.0.1:0", TLSConfig: certs.TLSConfig(), ClientAuth: RequiredClientCert})
+	require.Error(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Panics(t, func() {
+		NewServer(l, Config{TLSConfig: certs.TLSConfig(), ClientAuth: OptionalClientCert})
+	})
+
+	// Test: Client certificates without TLS
+	_, err = Listen(Config{Addr: "127.0.0.1:0", ClientAuth: RequiredClientCert, ClientCAs: pool})
+	require.Error(t, err)
+
+	// Test: CAs set on TLSConfig are kept
+	tlsConfig := certs.TLSConfig()
+	tlsConfig.ClientCAs = pool
+	cfg := clientAuthConfig(tlsConfig, RequiredClientCert, nil)
+	assert.Same(t, pool, cfg.ClientCAs)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUntrustedProxyHeader is returned by reads from a connection that sent a
+// PROXY protocol header without coming from a trusted proxy
+var ErrUntrustedProxyHeader = errors.New("PROXY header from untrusted source.")
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// maxProxyV1Header is the longest v1 header the specification allows
+const maxProxyV1Header = 107
+
+// ProxyListener reads the PROXY protocol header load balancers put in front
+// of the connection and reports the addresses it carries as the connection's
+// RemoteAddr and LocalAddr. Both the v1 text and the v2 binary format are
+// understood. The header is optional, connections from untrusted sources
+// that send one are rejected.
+type ProxyListener struct {
+	net.Listener
+	// Trusted lists the networks of the proxies allowed to send the header
+	Trusted []netip.Prefix
+	// HeaderTimeout limits reading the header
+	HeaderTimeout time.Duration
+}
+
+func NewProxyListener(l net.Listener, trusted []netip.Prefix) *ProxyListener {
+	return &ProxyListener{
+		Listener:      l,
+		Trusted:       trusted,
+		HeaderTimeout: defaultReadHeaderTimeout,
+	}
+}
+
+// Accept returns the next connection. Its header is read on the first Read,
+// RemoteAddr or LocalAddr call so a slow client doesn't hold up Accept.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ip, _ := addrIP(conn.RemoteAddr())
+	return &proxyConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: isTrusted(ip, l.Trusted),
+		timeout: l.HeaderTimeout,
+	}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted bool
+	timeout time.Duration
+
+	once sync.Once
+	// error reading the header, returned by every Read
+	err error
+	// addresses from the header, nil if there was none
+	remote, local net.Addr
+
+	mu sync.Mutex
+	// read deadline set by the user, restored after reading the header
+	readDeadline time.Time
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readHeader reads the header if there is one, leaving the rest of the
+// stream in reader
+func (c *proxyConn) readHeader() {
+	if c.timeout > 0 {
+		c.mu.Lock()
+		userDeadline := c.readDeadline
+		c.mu.Unlock()
+		headerDeadline := time.Now().Add(c.timeout)
+		if !userDeadline.IsZero() && userDeadline.Before(headerDeadline) {
+			headerDeadline = userDeadline
+		}
+		c.Conn.SetReadDeadline(headerDeadline)
+		defer func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+		}()
+	}
+
+	version, err := c.detect()
+	if err != nil || version == 0 {
+		c.err = err
+		return
+	}
+	if !c.trusted {
+		c.err = ErrUntrustedProxyHeader
+		return
+	}
+	if version == 1 {
+		c.remote, c.local, c.err = readProxyV1(c.reader)
+	} else {
+		c.remote, c.local, c.err = readProxyV2(c.reader)
+	}
+}
+
+// detect returns the version of the header at the start of the stream, or 0
+// if there is none. It peeks no further than needed to tell, so a short
+// request doesn't block it.
+func (c *proxyConn) detect() (int, error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return 0, ignoreEOF(err)
+	}
+	var prefix []byte
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix = proxyV1Prefix
+	case proxyV2Signature[0]:
+		prefix = proxyV2Signature
+	default:
+		return 0, nil
+	}
+	for i := 2; i <= len(prefix); i++ {
+		peeked, err := c.reader.Peek(i)
+		if err != nil {
+			return 0, ignoreEOF(err)
+		}
+		if !bytes.Equal(peeked, prefix[:i]) {
+			return 0, nil
+		}
+	}
+	if first[0] == proxyV1Prefix[0] {
+		return 1, nil
+	}
+	return 2, nil
+}
+
+// ignoreEOF lets a stream that ends before a header could be told apart be
+// read as it is
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n".
+// UNKNOWN connections have no addresses.
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < maxProxyV1Header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, errors.New("Malformed PROXY header.")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("Malformed PROXY header.")
+	}
+	src, err1 := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	dst, err2 := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(host, port string, ipv4 bool) (net.Addr, error) {
+	ip, err := netip.ParseAddr(host)
+	if err != nil || ip.Is4() != ipv4 {
+		return nil, errors.New("Invalid address in PROXY header.")
+	}
+	// ports are decimal without leading zeros
+	if port != "0" && strings.HasPrefix(port, "0") {
+		return nil, errors.New("Invalid port in PROXY header.")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("Invalid port in PROXY header.")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+// readProxyV2 reads a binary header. LOCAL connections, e.g. health checks
+// of the proxy itself, and families other than TCP over IPv4 and IPv6 have
+// no addresses. TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, nil, errors.New("Unsupported PROXY version.")
+	}
+	switch versionCommand & 0x0F {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errors.New("Unsupported PROXY command.")
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = 4
+	case 0x21: // TCP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY header too short for its addresses.")
+	}
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLen])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	return remote, local, nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header builds a v2 header for TCP over IPv4
+func proxyV2Header(command byte, src, dst netip.AddrPort) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, 0x11, 0, 12)
+	header = append(header, src.Addr().AsSlice()...)
+	header = append(header, dst.Addr().AsSlice()...)
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	header = binary.BigEndian.AppendUint16(header, dst.Port())
+	return string(header)
+}
+
+func TestProxyListener(t *testing.T) {
+	newServer := func(trusted string) (*Server, chan *request.Request) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		reqs := make(chan *request.Request, 1)
+		s := NewServer(NewProxyListener(l, []netip.Prefix{netip.MustParsePrefix(trusted)}), Config{
+			Handler: func(w *response.Writer, req *request.Request) {
+				reqs <- req
+				writeEmpty(w, response.StatusCodeOK)
+			},
+		})
+		return s, reqs
+	}
+	const get = "GET / HTTP/1.1\r\nConnection: close\r\n\r\n"
+	const ok = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+	s, reqs := newServer("127.0.0.0/8")
+	defer s.Close()
+
+	// Test: v1 header
+	resp := roundTrip(t, s, "PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"+get)
+	assert.Equal(t, ok, resp)
+	req := <-reqs
+	assert.Equal(t, "192.0.2.1:5000", req.PeerAddr.String())
+	assert.Equal(t, "192.0.2.1:5000", req.RemoteAddr.String())
+	assert.Equal(t, "192.0.2.2:80", req.LocalAddr.String())
+
+	// Test: v1 header for IPv6
+	resp = roundTrip(t, s, "PROXY TCP6 2001:db8::1 2001:db8::2 5000 443\r\n"+get)
+	assert.Equal(t, ok, resp)
+	assert.Equal(t, "[2001:db8::1]:5000", (<-reqs).PeerAddr.String())
+
+	// Test: v2 header
+	resp = roundTrip(t, s, proxyV2Header(0x1, netip.MustParseAddrPort("198.51.100.7:6000"), netip.MustParseAddrPort("198.51.100.8:443"))+get)
+	assert.Equal(t, ok, resp)
+	req = <-reqs
+	assert.Equal(t, "198.51.100.7:6000", req.PeerAddr.String())
+	assert.Equal(t, "198.51.100.8:443", req.LocalAddr.String())
+
+	// Test: v2 LOCAL and v1 UNKNOWN keep the connection's addresses
+	resp = roundTrip(t, s, proxyV2Header(0x0, netip.MustParseAddrPort("198.51.100.7:6000"), netip.MustParseAddrPort("198.51.100.8:443"))+get)
+	assert.Equal(t, ok, resp)
+	assert.True(t, strings.HasPrefix((<-reqs).PeerAddr.String(), "127.0.0.1:"))
+	resp = roundTrip(t, s, "PROXY UNKNOWN\r\n"+get)
+	assert.Equal(t, ok, resp)
+	assert.True(t, strings.HasPrefix((<-reqs).PeerAddr.String(), "127.0.0.1:"))
+
+	// Test: The header is optional
+	resp = roundTrip(t, s, "POST / HTTP/1.1\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, ok, resp)
+	<-reqs
+
+	// Test: Malformed headers close the connection
+	assert.Equal(t, "", roundTrip(t, s, "PROXY TCP4 192.0.2.1\r\n"+get))
+	assert.Equal(t, "", roundTrip(t, s, "PROXY TCP4 2001:db8::1 192.0.2.2 5000 80\r\n"+get))
+	assert.Equal(t, "", roundTrip(t, s, "PROXY TCP4 192.0.2.1 192.0.2.2 05000 80\r\n"+get))
+
+	// Test: Untrusted sources may not send a header
+	untrusted, reqs := newServer("10.0.0.0/8")
+	defer untrusted.Close()
+	assert.Equal(t, "", roundTrip(t, untrusted, "PROXY TCP4 192.0.2.1 192.0.2.2 5000 80\r\n"+get))
+	assert.Equal(t, ok, roundTrip(t, untrusted, get))
+	assert.True(t, strings.HasPrefix((<-reqs).PeerAddr.String(), "127.0.0.1:"))
+}
+
+func TestReadProxyV1(t *testing.T) {
+	// Test: Headers longer than allowed are rejected
+	long := "PROXY TCP6 " + strings.Repeat("a", maxProxyV1Header) + "\r\n"
+	_, _, err := readProxyV1(bufio.NewReader(strings.NewReader(long)))
+	require.Error(t, err)
+
+	_, _, err = readProxyV1(bufio.NewReader(strings.NewReader("PROXY UDP4 192.0.2.1 192.0.2.2 5000 80\r\n")))
+	require.Error(t, err)
+}
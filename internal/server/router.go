@@ -0,0 +1,234 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+)
+
+// Router dispatches requests to handlers registered by method, host and path
+// pattern. Pass its ServeRequest method to Serve as the Handler.
+type Router struct {
+	routes      []*route
+	middlewares []Middleware
+	// dispatch wrapped in middlewares, rebuilt by Use
+	handler Handler
+}
+
+type route struct {
+	method   string
+	host     string
+	segments []string
+	handler  Handler
+}
+
+func NewRouter() *Router {
+	rt := &Router{}
+	rt.handler = rt.dispatch
+	return rt
+}
+
+// Handle registers handler for pattern, which has the form
+//
+//	[METHOD ][HOST]/[PATH]
+//
+// e.g. "GET /videos/{id}" or "example.com/static/{path...}". A "{name}"
+// segment matches one path segment, a final "{name...}" matches the rest of
+// the path. The matched values are available through Request.PathValue.
+// Without a method the route matches every method, a GET route also matches
+// HEAD. The middlewares wrap only this route, in the order of Chain.
+// Handle panics if the pattern is invalid or already registered.
+func (rt *Router) Handle(pattern string, handler Handler, middlewares ...Middleware) {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("server: invalid pattern %q: %v", pattern, err))
+	}
+	for _, other := range rt.routes {
+		if other.method == r.method && other.host == r.host && slices.Equal(other.shape(), r.shape()) {
+			panic(fmt.Sprintf("server: pattern %q is already registered", pattern))
+		}
+	}
+	r.handler = Chain(middlewares...)(handler)
+	rt.routes = append(rt.routes, r)
+}
+
+// Use adds middlewares that wrap every request the router serves, including
+// the 404 and 405 responses. They run outside any per-route middleware.
+func (rt *Router) Use(middlewares ...Middleware) {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+	rt.handler = Chain(rt.middlewares...)(rt.dispatch)
+}
+
+func parsePattern(pattern string) (*route, error) {
+	r := route{}
+	if method, rest, ok := strings.Cut(pattern, " "); ok {
+		r.method = method
+		pattern = strings.TrimLeft(rest, " ")
+	}
+	i := strings.Index(pattern, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("missing path")
+	}
+	r.host = strings.ToLower(pattern[:i])
+	r.segments = strings.Split(pattern[i+1:], "/")
+	for j, segment := range r.segments {
+		name, isWildcard := wildcardName(segment)
+		if !isWildcard {
+			if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("segment %q is not a wildcard", segment)
+			}
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("wildcard without a name")
+		}
+		if strings.HasSuffix(segment, "...}") && j != len(r.segments)-1 {
+			return nil, fmt.Errorf("%q is not the last segment", segment)
+		}
+	}
+	return &r, nil
+}
+
+// shape returns the route's segments with wildcard names left out, routes of
+// the same shape match the same paths
+func (r *route) shape() []string {
+	shape := make([]string, len(r.segments))
+	for i, segment := range r.segments {
+		shape[i] = segment
+		if _, ok := wildcardName(segment); ok {
+			shape[i] = "{}"
+			if strings.HasSuffix(segment, "...}") {
+				shape[i] = "{...}"
+			}
+		}
+	}
+	return shape
+}
+
+// wildcardName returns the name of a "{name}" or "{name...}" segment
+func wildcardName(segment string) (string, bool) {
+	if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+		return "", false
+	}
+	return strings.TrimSuffix(segment[1:len(segment)-1], "..."), true
+}
+
+// ServeRequest calls the handler of the best matching route. It answers 404
+// Not Found if no route matches the path and 405 Method Not Allowed with an
+// Allow header if routes match the path but not the method.
+func (rt *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	rt.handler(w, req)
+}
+
+func (rt *Router) dispatch(w *response.Writer, req *request.Request) {
+	host := req.Host()
+	segments := strings.Split(req.RequestLine.Target.Path, "/")[1:]
+
+	var best *route
+	var bestValues map[string]string
+	var allowed []string
+	for _, r := range rt.routes {
+		values, ok := r.match(host, segments)
+		if !ok {
+			continue
+		}
+		if !r.matchesMethod(req.RequestLine.Method) {
+			allowed = append(allowed, r.method)
+			if r.method == request.MethodGet {
+				allowed = append(allowed, request.MethodHead)
+			}
+			continue
+		}
+		if best == nil || r.moreSpecific(best) {
+			best, bestValues = r, values
+		}
+	}
+
+	if best == nil && len(allowed) == 0 {
+		writeEmpty(w, response.StatusCodeNotFound)
+		return
+	}
+	if best == nil {
+		slices.Sort(allowed)
+		w.Headers.Set("Allow", strings.Join(slices.Compact(allowed), ", "))
+		writeEmpty(w, response.StatusCodeMethodNotAllowed)
+		return
+	}
+	req.PathValues = bestValues
+	best.handler(w, req)
+}
+
+// match reports whether the route matches host and the path segments and
+// returns the values of its wildcards
+func (r *route) match(host string, segments []string) (map[string]string, bool) {
+	if r.host != "" && !matchHost(r.host, host) {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, pattern := range r.segments {
+		name, isWildcard := wildcardName(pattern)
+		if isWildcard && strings.HasSuffix(pattern, "...}") {
+			values[name] = strings.Join(segments[min(i, len(segments)):], "/")
+			return values, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if isWildcard {
+			if segments[i] == "" {
+				return nil, false
+			}
+			values[name] = segments[i]
+		} else if pattern != segments[i] {
+			return nil, false
+		}
+	}
+	return values, len(segments) == len(r.segments)
+}
+
+// matchHost compares hosts case-insensitively, ignoring the port of the
+// request if the pattern has none
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if pattern == host {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil && !strings.Contains(pattern, ":") {
+		return pattern == hostname
+	}
+	return false
+}
+
+func (r *route) matchesMethod(method string) bool {
+	return r.method == "" || r.method == method || r.method == request.MethodGet && method == request.MethodHead
+}
+
+// moreSpecific reports whether r should win over other when both match.
+// Host routes beat hostless ones, then literal segments beat wildcards, then
+// routes for a method beat routes for any method.
+func (r *route) moreSpecific(other *route) bool {
+	if (r.host != "") != (other.host != "") {
+		return r.host != ""
+	}
+	if r.literals() != other.literals() {
+		return r.literals() > other.literals()
+	}
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+	return r.method != "" && other.method == ""
+}
+
+func (r *route) literals() int {
+	n := 0
+	for _, segment := range r.segments {
+		if _, isWildcard := wildcardName(segment); !isWildcard {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nameHandler answers with its name and the path values it received
+func nameHandler(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, key := range []string{"id", "path"} {
+			if v, ok := req.PathValues[key]; ok {
+				body += " " + key + "=" + v
+			}
+		}
+		w.StatusCode = response.StatusCodeOK
+		w.StatusPhrase = "OK"
+		w.BodyText = body
+		w.Headers.Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteStatusLine()
+		w.WriteHeaders()
+		w.WriteBody()
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET /videos/{id}", nameHandler("video"))
+	router.Handle("GET /videos/latest", nameHandler("latest"))
+	router.Handle("DELETE /videos/{id}", nameHandler("delete"))
+	router.Handle("/static/{path...}", nameHandler("static"))
+	router.Handle("GET admin.example.com/videos/{id}", nameHandler("admin"))
+	s, err := Serve(0, router.ServeRequest)
+	require.NoError(t, err)
+	defer s.Close()
+
+	tests := []struct {
+		request  string
+		response string
+	}{
+		{"GET /videos/42 HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nConnection: close\r\n\r\nvideo id=42"},
+		{"GET /videos/latest HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\nlatest"},
+		{"HEAD /videos/42 HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 11\r\nConnection: close\r\n\r\n"},
+		{"DELETE /videos/42 HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 12\r\nConnection: close\r\n\r\ndelete id=42"},
+		{"POST /static/css/site.css HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 24\r\nConnection: close\r\n\r\nstatic path=css/site.css"},
+		{"GET /static HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 12\r\nConnection: close\r\n\r\nstatic path="},
+		{"GET http://ADMIN.example.com:8080/videos/7 HTTP/1.1", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: close\r\n\r\nadmin id=7"},
+		{"GET /videos HTTP/1.1", "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"},
+		{"GET /videos/42/comments HTTP/1.1", "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"},
+		{"PUT /videos/42 HTTP/1.1", "HTTP/1.1 405 Method Not Allowed\r\nAllow: DELETE, GET, HEAD\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		resp := roundTrip(t, s, tt.request+"\r\nConnection: close\r\n\r\n")
+		assert.Equal(t, tt.response, resp, tt.request)
+	}
+
+	// Test: Host routes use the Host header of origin-form requests
+	resp := roundTrip(t, s, "GET /videos/7 HTTP/1.1\r\nHost: admin.example.com\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nConnection: close\r\n\r\nadmin id=7", resp)
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET /videos/{id}", nameHandler("video"))
+	router.Handle("GET /static/{path...}", nameHandler("static"))
+	for _, pattern := range []string{
+		"GET /static/{rest...}",
+		"GET videos",
+		"GET /videos/{}",
+		"GET /videos/{path...}/comments",
+		"GET /videos/id{id}",
+		"GET /videos/{id}",
+		"GET /videos/{name}",
+	} {
+		assert.Panics(t, func() { router.Handle(pattern, nameHandler("x")) }, pattern)
+	}
+}
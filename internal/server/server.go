@@ -1,40 +1,83 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/PavelVaavra/http-from-tcp/internal/headers"
 	"github.com/PavelVaavra/http-from-tcp/internal/request"
 	"github.com/PavelVaavra/http-from-tcp/internal/response"
 )
 
 type Handler func(w *response.Writer, req *request.Request)
 
+const (
+	defaultIdleTimeout         = 60 * time.Second
+	defaultReadHeaderTimeout   = 10 * time.Second
+	defaultReadBodyTimeout     = 30 * time.Second
+	defaultMaxRequestsPerConn  = 100
+	defaultMaxRequestLineBytes = 8 << 10
+	defaultMaxHeaderBytes      = 64 << 10
+	defaultMaxBodyBytes        = 10 << 20
+	lingerTimeout              = 500 * time.Millisecond
+)
+
+var defaultMethods = []string{
+	request.MethodGet,
+	request.MethodHead,
+	request.MethodPost,
+	request.MethodPut,
+	request.MethodPatch,
+	request.MethodDelete,
+	request.MethodOptions,
+}
+
 type Server struct {
+	Config
 	State    atomic.Bool //0..closed, 1..open
 	Listener net.Listener
-	Handler  Handler
+
+	// parent of all request contexts, cancelled when Shutdown starts or
+	// connections are force-closed
+	baseCtx    context.Context
+	cancelBase context.CancelCauseFunc
+	// connection slots when MaxConns is set
+	sem chan struct{}
+	// ID of the last accepted connection
+	lastConnID atomic.Uint64
+
+	mu sync.Mutex
+	// open connections, true while one is serving a request
+	conns map[net.Conn]bool
+	// running handle goroutines, waited for by Shutdown
+	handlers   sync.WaitGroup
+	onShutdown []func()
 }
 
+// Serve listens on all interfaces on port with the default configuration
 func Serve(port int, handler Handler) (*Server, error) {
-	l, err := net.Listen("tcp", ":"+fmt.Sprintf("%v", port))
-	if err != nil {
-		return nil, err
-	}
-	server := Server{
-		Listener: l,
-		Handler:  handler,
-	}
-	server.State.Store(true)
-	go server.listen()
-
-	return &server, nil
+	return Listen(Config{Addr: ":" + fmt.Sprintf("%v", port), Handler: handler})
 }
 
+// Close stops accepting connections and closes all open ones immediately.
+// Use Shutdown to let active requests finish.
 func (s *Server) Close() error {
 	s.State.Store(false)
 	err := s.Listener.Close()
+	s.cancelBase(nil)
+	s.closeConns()
 	if err != nil {
 		return err
 	}
@@ -43,33 +86,273 @@ func (s *Server) Close() error {
 
 func (s *Server) listen() {
 	for {
+		if s.sem != nil {
+			s.sem <- struct{}{}
+		}
 		// Wait for a connection.
 		conn, err := s.Listener.Accept()
 		if err != nil {
+			s.releaseSlot()
 			if !s.State.Load() {
 				return
 			} else {
-				fmt.Println(err.Error())
+				s.logf("accept: %v", err)
 				continue
 			}
 		}
+		if !s.trackConn(conn) {
+			s.releaseSlot()
+			conn.Close()
+			return
+		}
 		fmt.Println("A connection has been accepted...")
 		go s.handle(conn)
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		fmt.Printf("could not parse HTTP request: error:%v\n", err.Error())
+	defer func() {
+		conn.Close()
+		s.untrackConn(conn)
+		s.releaseSlot()
+		fmt.Println("A connection has been closed...")
+	}()
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state, err := handshake(s.baseCtx, tlsConn, s.ReadHeaderTimeout)
+		if err != nil {
+			s.logf("TLS handshake error from %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		tlsState = &state
+	}
+
+	connID := s.lastConnID.Add(1)
+	watched := &watchedConn{Conn: conn}
+	reader := request.NewReader(watched)
+	reader.HeaderTimeout = s.ReadHeaderTimeout
+	reader.BodyTimeout = s.ReadBodyTimeout
+	reader.StreamBody = s.StreamBodies
+	reader.MaxRequestLineBytes = s.MaxRequestLineBytes
+	reader.MaxHeaderBytes = s.MaxHeaderBytes
+	reader.MaxBodyBytes = s.MaxBodyBytes
+	// a connection a request is arriving on isn't idle, Shutdown must not
+	// close it
+	reader.OnStart = func() { s.setActive(conn, true) }
+	for served := 1; ; served++ {
+		if !s.setActive(conn, false) {
+			return
+		}
+		conn.SetReadDeadline(deadline(s.IdleTimeout))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logf("could not parse HTTP request: %v", err)
+			var parseErr *request.ParseError
+			if errors.As(err, &parseErr) {
+				conn.SetWriteDeadline(deadline(s.WriteTimeout))
+				s.writeError(conn, parseErrorStatus(parseErr.Kind))
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn.SetWriteDeadline(deadline(s.WriteTimeout))
+		req.TLS = tlsState
+		req.PeerAddr = conn.RemoteAddr()
+		req.RemoteAddr = clientAddr(req.PeerAddr, req.Headers, s.TrustedProxies)
+		req.LocalAddr = conn.LocalAddr()
+		req.ConnID = connID
+		req.Seq = served
+
+		w := response.Writer{
+			Conn:        conn,
+			OmitBody:    req.RequestLine.Method == request.MethodHead,
+			HttpVersion: req.RequestLine.HttpVersion,
+			KeepAlive:   wantsKeepAlive(req) && served < s.MaxRequestsPerConn && s.State.Load(),
+			Server:      s.ServerHeader,
+		}
+		ok := s.serveWithContext(watched, &w, req)
+		if !ok {
+			return
+		}
+		// Complete what the handler left open, a short body breaks the framing
+		if err := w.Finish(); err != nil {
+			if errors.Is(err, response.ErrIncompleteBody) {
+				s.logf("response to %v %v: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+				lingerClose(conn)
+			}
+			return
+		}
+
+		// Discard what the handler didn't read so the next request can be parsed.
+		// If there is too much, the client must still get the response.
+		if err := req.BodyReader.Close(); err != nil {
+			lingerClose(conn)
+			return
+		}
+		if !keepAlive(&w) {
+			return
+		}
+	}
+}
+
+// releaseSlot frees the MaxConns slot taken before accepting a connection
+func (s *Server) releaseSlot() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
 		return
 	}
+	log.Printf(format, args...)
+}
+
+// serveWithContext attaches a context to req that is cancelled when the
+// client disconnects, the server shuts down or HandlerTimeout passes,
+// then calls serveRecover. Disconnects are only noticed once the body has
+// been received, so not while a streamed body is still arriving.
+func (s *Server) serveWithContext(conn *watchedConn, w *response.Writer, req *request.Request) bool {
+	ctx, cancel := context.WithCancel(s.baseCtx)
+	defer cancel()
+	if s.HandlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.HandlerTimeout)
+		defer cancel()
+	}
+	if req.BodyReceived() {
+		stop := conn.watch(cancel)
+		defer stop()
+	}
+	return s.serveRecover(w, req.WithContext(ctx))
+}
 
+// serveRecover calls serve and recovers a panicking handler. A 500 response
+// is sent if the handler hadn't written the status line yet, either way the
+// connection is closed since the response may be incomplete. It reports
+// whether serve returned normally.
+func (s *Server) serveRecover(w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		s.logf("handler panic serving %v %v: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, r, debug.Stack())
+		if !w.Committed() {
+			w.Headers = headers.Headers{}
+			w.Headers.Set("Connection", "close")
+			writeEmpty(w, response.StatusCodeInternalServerError)
+		}
+		w.Abort()
+		lingerClose(w.Conn)
+		ok = false
+	}()
+	s.serve(w, req)
+	return true
+}
+
+// serve answers the requests the server handles itself and passes the rest
+// to Handler
+func (s *Server) serve(w *response.Writer, req *request.Request) {
+	if !slices.Contains(s.Methods, req.RequestLine.Method) {
+		writeEmpty(w, response.StatusCodeNotImplemented)
+		return
+	}
+	if req.RequestLine.Method == request.MethodOptions && req.RequestLine.Target.Form == request.AsteriskForm {
+		w.Headers.Set("Allow", strings.Join(s.Methods, ", "))
+		writeEmpty(w, response.StatusCodeOK)
+		return
+	}
+	s.Handler(w, req)
+}
+
+// writeEmpty sends a response without a body
+func writeEmpty(w *response.Writer, statusCode response.StatusCode) {
+	w.StatusCode = statusCode
+	w.Headers.Set("Content-Length", "0")
+	w.Finish()
+}
+
+// parseErrorStatus returns the response status for an invalid request
+func parseErrorStatus(kind request.ParseErrorKind) response.StatusCode {
+	switch kind {
+	case request.UnsupportedVersion:
+		return response.StatusCodeHTTPVersionNotSupported
+	case request.URITooLong:
+		return response.StatusCodeURITooLong
+	case request.HeadersTooLarge:
+		return response.StatusCodeRequestHeaderFieldsTooLarge
+	case request.BodyTooLarge:
+		return response.StatusCodeContentTooLarge
+	case request.Timeout:
+		return response.StatusCodeRequestTimeout
+	default:
+		return response.StatusCodeBadRequest
+	}
+}
+
+// writeError sends a bodyless error response before the connection is closed
+func (s *Server) writeError(conn net.Conn, statusCode response.StatusCode) {
 	w := response.Writer{
-		Conn: conn,
+		Conn:   conn,
+		Server: s.ServerHeader,
+	}
+	w.Headers.Set("Connection", "close")
+	writeEmpty(&w, statusCode)
+	lingerClose(conn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// lingerClose half-closes the connection and discards what the client still
+// sends. Closing with unread input would reset the connection and the client
+// could lose the error response.
+func lingerClose(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.Copy(io.Discard, conn)
+}
+
+// wantsKeepAlive reports whether the client wants to reuse the connection.
+// HTTP/1.1 connections are persistent by default, HTTP/1.0 ones must ask.
+func wantsKeepAlive(req *request.Request) bool {
+	if hasToken(req.Headers, "connection", "close") {
+		return false
 	}
-	s.Handler(&w, req)
+	if req.RequestLine.HttpVersion == "1.0" {
+		return hasToken(req.Headers, "connection", "keep-alive")
+	}
+	return true
+}
+
+// keepAlive reports whether the connection can be reused after the response
+func keepAlive(w *response.Writer) bool {
+	if !w.KeepAlive || hasToken(w.Headers, "connection", "close") {
+		return false
+	}
+	// Without framing the client reads the body until the connection is closed
+	return !w.CloseDelimited()
+}
 
-	conn.Close()
-	fmt.Println("A connection has been closed...")
+// hasToken reports whether the comma separated header value contains token
+func hasToken(h headers.Headers, key, token string) bool {
+	value, err := h.Get(key)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func textHandler(w *response.Writer, req *request.Request) {
+	w.StatusCode = response.StatusCodeOK
+	w.StatusPhrase = "OK"
+	w.BodyText = req.RequestLine.RequestTarget
+	w.Headers.Set("Content-Length", fmt.Sprint(len(w.BodyText)))
+	w.WriteStatusLine()
+	w.WriteHeaders()
+	w.WriteBody()
+}
+
+// roundTrip sends raw to a new connection and returns everything the server
+// writes back until it closes the connection
+func roundTrip(t *testing.T, s *Server, raw string) string {
+	addr := s.Listener.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write([]byte(raw))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return stripDate(string(resp))
+}
+
+var dateHeader = regexp.MustCompile(`Date: [^\r]*\r\n`)
+
+// stripDate removes the Date headers, which change from second to second
+func stripDate(resp string) string {
+	return dateHeader.ReplaceAllString(resp, "")
+}
+
+func TestServe(t *testing.T) {
+	s, err := Serve(0, textHandler)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Keep-alive until the client asks to close
+	resp := roundTrip(t, s, "GET /first HTTP/1.1\r\n\r\n"+
+		"GET /secnd HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\n/first"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/secnd", resp)
+
+	// Test: HEAD gets the headers without the body
+	resp = roundTrip(t, s, "HEAD /first HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n", resp)
+
+	// Test: OPTIONS * lists the implemented methods
+	resp = roundTrip(t, s, "OPTIONS * HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Allow: GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS\r\n"+
+		"Content-Length: 0\r\nConnection: close\r\n\r\n", resp)
+
+	// Test: Methods the handler doesn't implement
+	resp = roundTrip(t, s, "TRACE / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 501 Not Implemented\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", resp)
+
+	// Test: HTTP/1.0 closes by default
+	resp = roundTrip(t, s, "GET /first HTTP/1.0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/first", resp)
+
+	// Test: HTTP/1.0 keep-alive on request
+	resp = roundTrip(t, s, "GET /first HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"+
+		"GET /secnd HTTP/1.0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: keep-alive\r\n\r\n/first"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/secnd", resp)
+
+	// Test: Malformed request
+	resp = roundTrip(t, s, "GET /first\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", resp)
+
+	// Test: Body over the limit
+	resp = roundTrip(t, s, "POST /first HTTP/1.1\r\nContent-Length: 999999999\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", resp)
+
+	// Test: Unknown HTTP version
+	resp = roundTrip(t, s, "GET / HTTP/2.0\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 505 HTTP Version Not Supported\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", resp)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Target.Path == "/late" {
+			w.StatusCode = response.StatusCodeOK
+			w.StatusPhrase = "OK"
+			w.Headers.Set("Content-Length", "10")
+			w.WriteStatusLine()
+			w.WriteHeaders()
+		}
+		var res *http.Response
+		_ = res.Body
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Panic before the status line is answered with 500
+	resp := roundTrip(t, s, "GET /early HTTP/1.1\r\n\r\nGET /early HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", resp)
+
+	// Test: Panic after the status line aborts the connection
+	resp = roundTrip(t, s, "GET /late HTTP/1.1\r\n\r\nGET /late HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n", resp)
+}
+
+func TestRequestContext(t *testing.T) {
+	cancelled := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Client disconnect cancels the context
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled after disconnect")
+	}
+
+	// Test: Disconnects are noticed with streamed bodies once there is no
+	// body left to arrive
+	s.StreamBodies = true
+	conn, err = net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled after disconnect with StreamBodies")
+	}
+	s.StreamBodies = false
+
+	// Test: HandlerTimeout ends the context
+	s.HandlerTimeout = 50 * time.Millisecond
+	conn, err = net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	select {
+	case err := <-cancelled:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("context not cancelled after HandlerTimeout")
+	}
+}
+
+type ctxKey struct{}
+
+func TestRequestContextValues(t *testing.T) {
+	withUser := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req.WithContext(context.WithValue(req.Context(), ctxKey{}, "pavel")))
+		}
+	}
+	s, err := Serve(0, withUser(func(w *response.Writer, req *request.Request) {
+		w.StatusCode = response.StatusCodeOK
+		w.StatusPhrase = "OK"
+		w.BodyText = req.Context().Value(ctxKey{}).(string)
+		w.Headers.Set("Content-Length", fmt.Sprint(len(w.BodyText)))
+		w.WriteStatusLine()
+		w.WriteHeaders()
+		w.WriteBody()
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Values attached by middleware reach the handler, pipelining still works
+	resp := roundTrip(t, s, "GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\npavel"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\npavel", resp)
+}
+
+func TestConnectionMetadata(t *testing.T) {
+	reqs := make(chan *request.Request, 3)
+	s, err := Listen(Config{
+		Addr:           "127.0.0.1:0",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		Handler: func(w *response.Writer, req *request.Request) {
+			reqs <- req
+			writeEmpty(w, response.StatusCodeOK)
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	start := time.Now()
+	roundTrip(t, s, "GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nX-Forwarded-For: 198.51.100.1\r\nConnection: close\r\n\r\n")
+	roundTrip(t, s, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	first, second, third := <-reqs, <-reqs, <-reqs
+
+	// Test: Addresses, IDs and sequence numbers
+	assert.Equal(t, s.Listener.Addr().String(), first.LocalAddr.String())
+	assert.Equal(t, first.PeerAddr, first.RemoteAddr)
+	assert.Equal(t, first.PeerAddr, second.PeerAddr)
+	assert.Equal(t, "198.51.100.1:0", second.RemoteAddr.String())
+	assert.Equal(t, first.ConnID, second.ConnID)
+	assert.NotEqual(t, first.ConnID, third.ConnID)
+	assert.Equal(t, 1, first.Seq)
+	assert.Equal(t, 2, second.Seq)
+	assert.Equal(t, 1, third.Seq)
+	assert.False(t, first.ReceivedAt.Before(start))
+	assert.False(t, second.ReceivedAt.Before(first.ReceivedAt))
+}
+
+func TestFinishResponse(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.Target.Path {
+		case "/chunked":
+			w.WriteChunkedBody([]byte("hello"))
+		case "/short":
+			w.Headers.Set("Content-Length", "10")
+			w.BodyText = "short"
+			w.WriteBody()
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Empty and unfinished chunked responses are completed, the
+	// connection stays open
+	resp := roundTrip(t, s, "GET /empty HTTP/1.1\r\n\r\nGET /chunked HTTP/1.1\r\n\r\nGET /empty HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", resp)
+
+	// Test: A body shorter than its Content-Length closes the connection
+	resp = roundTrip(t, s, "GET /short HTTP/1.1\r\n\r\nGET /empty HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort", resp)
+}
+
+func TestAutomaticHeaders(t *testing.T) {
+	s, err := Listen(Config{
+		Addr:         "127.0.0.1:0",
+		ServerHeader: "http-from-tcp",
+		Handler: func(w *response.Writer, req *request.Request) {
+			if req.RequestLine.Target.Path == "/anonymous" {
+				w.Server = ""
+			}
+			w.BodyText = "hello"
+			w.WriteBody()
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	addr := s.Listener.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\nGET /anonymous HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	// Test: Every response is dated
+	dates := dateHeader.FindAllString(string(raw), -1)
+	require.Len(t, dates, 2)
+	_, err = time.Parse(http.TimeFormat, strings.TrimSuffix(strings.TrimPrefix(dates[0], "Date: "), "\r\n"))
+	assert.NoError(t, err)
+
+	// Test: Configured Server header, handlers may drop it
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nServer: http-from-tcp\r\n\r\nhello"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello", stripDate(string(raw)))
+}
+
+func TestUnreadBody(t *testing.T) {
+	s, err := Listen(Config{Addr: "127.0.0.1:0", StreamBodies: true, Handler: textHandler})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: A body too large to drain doesn't cost the client the response
+	body := strings.Repeat("x", 1<<20)
+	resp := roundTrip(t, s, "POST /upload HTTP/1.1\r\nContent-Length: "+fmt.Sprint(len(body))+"\r\n\r\n"+body)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 7\r\n\r\n/upload", resp)
+}
+
+func TestBodylessKeepAlive(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.Target.Path {
+		case "/nc":
+			w.StatusCode = response.StatusCodeNoContent
+		case "/nm":
+			w.StatusCode = response.StatusCodeNotModified
+		default:
+			textHandler(w, req)
+		}
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Responses that can't have a body don't end the connection
+	resp := roundTrip(t, s, "GET /nc HTTP/1.1\r\n\r\nGET /nm HTTP/1.1\r\n\r\nGET /last HTTP/1.1\r\nConnection: close\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n"+
+		"HTTP/1.1 304 Not Modified\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\n/last", resp)
+}
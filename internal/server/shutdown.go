@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrServerShutdown is the cause of request contexts cancelled by Shutdown,
+// see context.Cause
+var ErrServerShutdown = errors.New("Server is shutting down.")
+
+// Shutdown stops accepting connections, closes idle keep-alive connections
+// and waits for active requests to finish. Connections are closed after their
+// current response. If ctx ends first, the remaining connections are closed
+// immediately and ctx's error is returned. The contexts of active requests
+// are cancelled right away with ErrServerShutdown as cause, so handlers can
+// wrap up, and the callbacks registered with RegisterOnShutdown are started
+// in their own goroutines.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.State.Store(false)
+	err := s.Listener.Close()
+	s.cancelBase(ErrServerShutdown)
+
+	s.mu.Lock()
+	for _, f := range s.onShutdown {
+		go f()
+	}
+	for conn, active := range s.conns {
+		if !active {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// RegisterOnShutdown registers f to be called when Shutdown starts, e.g. to
+// tell long-running handlers to wrap up.
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// trackConn registers a new connection as idle. It reports false if the
+// server is shutting down and conn must not be served.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.State.Load() {
+		return false
+	}
+	s.conns[conn] = false
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	s.handlers.Done()
+}
+
+// setActive marks conn as serving a request or as idle. It reports false if
+// conn should be closed instead of waiting for the next request because the
+// server is shutting down.
+func (s *Server) setActive(conn net.Conn, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !active && !s.State.Load() {
+		return false
+	}
+	s.conns[conn] = active
+	return true
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
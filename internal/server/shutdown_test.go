@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Target.Path == "/slow" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		textHandler(w, req)
+	})
+	require.NoError(t, err)
+	hookCalled := make(chan struct{})
+	s.RegisterOnShutdown(func() { close(hookCalled) })
+
+	// an idle keep-alive connection
+	idle, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	idle.Write([]byte("GET /first HTTP/1.1\r\n\r\n"))
+	buff := make([]byte, 1024)
+	_, err = idle.Read(buff)
+	require.NoError(t, err)
+
+	// an active request
+	active, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+	active.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	<-started
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	<-hookCalled
+
+	// Test: The active request finished before its connection was closed
+	resp, err := io.ReadAll(active)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n/slow", stripDate(string(resp)))
+
+	// Test: The idle connection was closed
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(buff)
+	require.ErrorIs(t, err, io.EOF)
+
+	// Test: New connections are refused
+	_, err = net.Dial("tcp", s.Listener.Addr().String())
+	require.Error(t, err)
+}
+
+func TestShutdownPartialRequest(t *testing.T) {
+	s, err := Serve(0, textHandler)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("GET /first HTTP/1.1\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("\r\n"))
+
+	// Test: A request that was arriving when Shutdown began is answered
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\n/first", stripDate(string(resp)))
+	require.NoError(t, <-shutdown)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		time.Sleep(time.Second)
+	})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: Connections still active at the deadline are closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdownCancelsContext(t *testing.T) {
+	started := make(chan struct{})
+	cause := make(chan error, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-req.Context().Done()
+		cause <- context.Cause(req.Context())
+		writeEmpty(w, response.StatusCodeServiceUnavailable)
+	})
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	<-started
+
+	// Test: Handlers learn that shutdown began and may still respond
+	require.NoError(t, s.Shutdown(context.Background()))
+	require.ErrorIs(t, <-cause, ErrServerShutdown)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n", stripDate(string(resp)))
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificates holds certificate/key pairs loaded from disk and picks one per
+// connection by the server name the client asks for (SNI). Reload reads the
+// files again, so renewed certificates are used without a restart.
+type Certificates struct {
+	mu    sync.RWMutex
+	files []certFiles
+	certs []*tls.Certificate
+	// certificates by the DNS names they cover, wildcards as "*.example.com"
+	byName map[string]*tls.Certificate
+}
+
+type certFiles struct {
+	cert, key string
+}
+
+func NewCertificates() *Certificates {
+	return &Certificates{byName: map[string]*tls.Certificate{}}
+}
+
+// Add loads a certificate/key pair. The first pair added is the default for
+// clients that don't send a server name or ask for an unknown one.
+func (c *Certificates) Add(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = append(c.files, certFiles{certFile, keyFile})
+	c.certs = append(c.certs, &cert)
+	c.index()
+	return nil
+}
+
+// Reload loads all pairs from disk again. If any of them fails, the
+// certificates in use are kept and the error is returned.
+func (c *Certificates) Reload() error {
+	c.mu.RLock()
+	files := c.files
+	c.mu.RUnlock()
+
+	certs := make([]*tls.Certificate, 0, len(files))
+	for _, f := range files {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, &cert)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certs = certs
+	c.index()
+	return nil
+}
+
+// index rebuilds byName, earlier pairs win when names overlap
+func (c *Certificates) index() {
+	c.byName = map[string]*tls.Certificate{}
+	for _, cert := range c.certs {
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := c.byName[name]; !ok {
+				c.byName[name] = cert
+			}
+		}
+	}
+}
+
+// GetCertificate selects the certificate for a handshake, it fits
+// tls.Config.GetCertificate
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.certs) == 0 {
+		return nil, errors.New("No certificates loaded.")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := c.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+// TLSConfig returns a TLS configuration serving the certificates, to be used
+// as Config.TLSConfig
+func (c *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.GetCertificate,
+	}
+}
+
+// handshake runs the TLS handshake within timeout, so that errors are noticed
+// before the first request is read
+func handshake(ctx context.Context, conn *tls.Conn, timeout time.Duration) (tls.ConnectionState, error) {
+	conn.SetDeadline(deadline(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PavelVaavra/http-from-tcp/internal/request"
+	"github.com/PavelVaavra/http-from-tcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate for names and its key to dir
+// and returns the file names
+func writeCert(t *testing.T, dir string, serial int64, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, names[0]+".crt")
+	keyFile := filepath.Join(dir, names[0]+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certs := NewCertificates()
+	require.NoError(t, certs.Add(writeCert(t, dir, 1, "example.com")))
+	require.NoError(t, certs.Add(writeCert(t, dir, 2, "api.test", "*.api.test")))
+
+	serial := func(serverName string) int64 {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err)
+		return cert.Leaf.SerialNumber.Int64()
+	}
+
+	// Test: Selection by server name, wildcards and the default
+	assert.Equal(t, int64(1), serial("example.com"))
+	assert.Equal(t, int64(2), serial("API.test"))
+	assert.Equal(t, int64(2), serial("v1.api.test"))
+	assert.Equal(t, int64(1), serial("unknown.org"))
+	assert.Equal(t, int64(1), serial(""))
+
+	// Test: Reload picks up renewed files
+	writeCert(t, dir, 3, "example.com")
+	require.NoError(t, certs.Reload())
+	assert.Equal(t, int64(3), serial("example.com"))
+
+	// Test: A broken file keeps the loaded certificates
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "example.com.key"), []byte("garbage"), 0o600))
+	require.Error(t, certs.Reload())
+	assert.Equal(t, int64(3), serial("example.com"))
+
+	_, err := NewCertificates().GetCertificate(&tls.ClientHelloInfo{})
+	require.Error(t, err)
+}
+
+func TestServeTLS(t *testing.T) {
+	certs := NewCertificates()
+	certFile, keyFile := writeCert(t, t.TempDir(), 1, "localhost")
+	require.NoError(t, certs.Add(certFile, keyFile))
+
+	s, err := Listen(Config{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: certs.TLSConfig(),
+		Handler: func(w *response.Writer, req *request.Request) {
+			w.StatusCode = response.StatusCodeOK
+			w.StatusPhrase = "OK"
+			w.BodyText = fmt.Sprint(req.TLS.ServerName, " ", tls.VersionName(req.TLS.Version))
+			w.Headers.Set("Content-Length", fmt.Sprint(len(w.BodyText)))
+			w.WriteStatusLine()
+			w.WriteHeaders()
+			w.WriteBody()
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	caPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	pool.AppendCertsFromPEM(caPEM)
+
+	// Test: The handler sees the negotiated TLS state
+	conn, err := tls.Dial("tcp", s.Listener.Addr().String(), &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS13,
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 17\r\nConnection: close\r\n\r\nlocalhost TLS 1.3", stripDate(string(resp)))
+}